@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0sc/sicuro/ci"
+)
+
+// apiLogChunk is a slice of a build log starting at Offset
+// Clients tail a log by requesting the next chunk from NextOffset until the build is Finished
+type apiLogChunk struct {
+	Build      string `json:"build"`
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"next_offset"`
+	Data       string `json:"data"`
+	Active     bool   `json:"active"`
+	Status     string `json:"status"`
+	Finished   bool   `json:"finished"`
+}
+
+// apiBuild is a build in the listing of a project's builds
+type apiBuild struct {
+	Name string `json:"name"`
+	// Key is what the build tested e.g owner/project/sha; rebuilding the key starts a new build
+	Key      string    `json:"key"`
+	Number   int       `json:"number"`
+	Branch   string    `json:"branch,omitempty"`
+	Active   bool      `json:"active"`
+	Status   string    `json:"status"`
+	Triggers []string  `json:"triggers"`
+	Reason   string    `json:"reason,omitempty"`
+	Notice   string    `json:"notice,omitempty"`
+	MergeSHA string    `json:"merge_sha,omitempty"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+func newAPIBuild(b *ci.Build) apiBuild {
+	return apiBuild{
+		Name:     b.Name,
+		Key:      b.Key,
+		Number:   b.Number,
+		Branch:   b.Branch,
+		Active:   b.Status == ci.StatusPending,
+		Status:   b.Status,
+		Triggers: b.Triggers,
+		Reason:   b.Reason,
+		Notice:   b.Notice,
+		MergeSHA: b.MergeSHA,
+		QueuedAt: b.QueuedAt,
+	}
+}
+
+// apiBuildsHandler lists a page of the project's builds, most recent first, filtered like the build history page
+// e.g /api/builds?owner=0sc&project=sicuro&branch=master&status=failure&page=2
+// The next and previous pages are linked in the Link header
+func apiBuildsHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		project := fmt.Sprintf("%s/%s", params.Get("owner"), params.Get("project"))
+		filter := ci.BuildFilter{Branch: params.Get("branch"), Status: params.Get("status")}
+
+		page, _ := strconv.Atoi(params.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		history := ci.ProjectBuilds(project, filter)
+		start, end := paginate(len(history), page, buildsPerPage)
+
+		links := []string{}
+		if page > 1 {
+			links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(r, page-1)))
+		}
+		if end < len(history) {
+			links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(r, page+1)))
+		}
+		if len(links) > 0 {
+			w.Header().Set("Link", strings.Join(links, ", "))
+		}
+
+		builds := []apiBuild{}
+		for _, b := range history[start:end] {
+			builds = append(builds, newAPIBuild(b))
+		}
+		renderJSON(w, http.StatusOK, builds)
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("GET"),
+		authenticationMiddleware,
+		requireScope(scopeRead),
+		authorizationMiddleware,
+		projectSubscriptionMiddleware,
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+func apiRunHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sha") == "" {
+			renderJSONError(w, http.StatusBadRequest, "A ref to build is required e.g repo=owner/project/sha")
+			return
+		}
+
+		name := triggerBuild(r)
+		renderJSON(w, http.StatusAccepted, map[string]string{
+			"build": name,
+			"url":   fmt.Sprintf("http://%s%s%s", r.Host, ciPath, name),
+			"log":   apiLogsPath + name,
+		})
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("POST"),
+		parseProjectDetailsMiddleware,
+		authenticationMiddleware,
+		requireScope(scopeBuild),
+		authorizationMiddleware,
+		projectSubscriptionMiddleware,
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+func apiLogsHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		name, _ := filepath.Rel(apiLogsPath, r.URL.Path)
+		if strings.HasPrefix(name, "..") {
+			renderJSONError(w, http.StatusNotFound, "Not found")
+			return
+		}
+
+		logFile := logFilePathFromRequest(apiLogsPath, r)
+		file, err := os.Open(logFile)
+		if err != nil {
+			renderJSONError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		defer file.Close()
+
+		offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			renderJSONError(w, http.StatusBadRequest, "Invalid offset")
+			return
+		}
+
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			renderJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		chunk := apiLogChunk{
+			Build:      name,
+			Offset:     offset,
+			NextOffset: offset + int64(len(data)),
+			Data:       string(data),
+			Active:     ci.ActiveCISession(logFile),
+		}
+		if b := ci.FindBuild(name); b != nil {
+			chunk.Status = b.Status
+			chunk.Finished = b.Finished() && !chunk.Active
+		} else {
+			// logs without a build record e.g those written before builds were recorded can't grow anymore
+			// unless they're being written to
+			chunk.Finished = !chunk.Active
+		}
+		renderJSON(w, http.StatusOK, chunk)
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("GET"),
+		parseLogPathMiddleware,
+		authenticationMiddleware,
+		requireScope(scopeRead),
+		authorizationMiddleware,
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+// parseLogPathMiddleware adds the owner and project of the build in the log path e.g /api/logs/owner/project/builds/1
+// to the query so the request can be authorized against the project
+func parseLogPathMiddleware(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, _ := filepath.Rel(apiLogsPath, r.URL.Path)
+		details := strings.Split(filepath.ToSlash(name), "/")
+		if len(details) < 3 || details[0] == ".." {
+			renderJSONError(w, http.StatusNotFound, "Not found")
+			return
+		}
+
+		values := r.URL.Query()
+		values.Set("owner", details[0])
+		values.Set("project", details[1])
+		r.URL.RawQuery = values.Encode()
+
+		f.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseLogPathMiddleware(t *testing.T) {
+	cases := []struct {
+		path           string
+		status         int
+		owner, project string
+	}{
+		{"/api/logs/octocat/hello/builds/3", http.StatusOK, "octocat", "hello"},
+		{"/api/logs/octocat/hello/builds/3?offset=10", http.StatusOK, "octocat", "hello"},
+		{"/api/logs/octocat", http.StatusNotFound, "", ""},
+		{"/api/logs/../data/users", http.StatusNotFound, "", ""},
+	}
+
+	for _, c := range cases {
+		var owner, project string
+		next := func(w http.ResponseWriter, r *http.Request) {
+			owner = r.URL.Query().Get("owner")
+			project = r.URL.Query().Get("project")
+		}
+
+		w := httptest.NewRecorder()
+		parseLogPathMiddleware(next)(w, httptest.NewRequest("GET", c.path, nil))
+		if w.Code != c.status || owner != c.owner || project != c.project {
+			t.Errorf("%s: got %d %s/%s; want %d %s/%s", c.path, w.Code, owner, project, c.status, c.owner, c.project)
+		}
+	}
+}
@@ -82,17 +82,22 @@ func ghAuthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// client := github.NewClient(githubOAuth.Client(oauth2.NoContext, tkn))
+	login, err := newGithubClient(tkn.AccessToken).Username()
+	if err != nil {
+		log.Println("Error occurred while getting user login: ", err)
+		renderTemplate(w, "error", "We couldn't retrieve your Github profile. Please try again")
+		return
+	}
 
-	// user, _, err := client.Users.Get(context.Background(), "")
-	// if err != nil {
-	// 	log.Println("Error occurred while getting user name: ", err)
-	// 	fmt.Println(w, "error getting name")
-	// 	return
-	// }
+	if err := saveUser(login, tkn); err != nil {
+		log.Println("Error occurred while saving user: ", err)
+		renderTemplate(w, "error", "Something went wrong while handling your token. Please try again")
+		return
+	}
 
-	// session.Values["name"] = user.Name
-	session.Values[accessTokenKey] = tkn.AccessToken
+	// the token itself is kept encrypted server side; see saveUser
+	session.Values[loginKey] = login
+	delete(session.Values, accessTokenKey)
 	err = session.Save(r, w)
 	if err != nil {
 		log.Println("Error occurred while saving access token: ", err)
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0sc/sicuro/app/vcs"
+	"github.com/0sc/sicuro/ci"
+	"github.com/google/go-github/github"
+)
+
+const (
+	badgeLabel = "sicuro"
+	// badgeMaxAge is how long in seconds clients and proxies may cache a badge
+	badgeMaxAge = 60
+	// badgeCharWidth is the approximate width in pixels of a character in the badge font
+	badgeCharWidth = 7
+	// badgePadding is the horizontal space in pixels around each side of the badge text
+	badgePadding = 6
+	// badgeRepoTTL is how long what's known of a repo's visibility and default branch is reused
+	badgeRepoTTL = 10 * time.Minute
+)
+
+// badgeColors maps the statuses shown on badges to their colours
+var badgeColors = map[string]string{
+	ci.StatusSuccess: "#4c1",
+	ci.StatusFailure: "#e05d44",
+	ci.StatusError:   "#9f9f9f",
+	"unknown":        "#9f9f9f",
+}
+
+// badge holds the dimensions of a badge's two halves: the label and the status
+type badge struct {
+	Label       string
+	Status      string
+	Color       string
+	LabelWidth  int
+	StatusWidth int
+}
+
+func newBadge(status string) badge {
+	return badge{
+		Label:       badgeLabel,
+		Status:      status,
+		Color:       badgeColors[status],
+		LabelWidth:  len(badgeLabel)*badgeCharWidth + 2*badgePadding,
+		StatusWidth: len(status)*badgeCharWidth + 2*badgePadding,
+	}
+}
+
+// Width is the width of the whole badge
+func (b badge) Width() int {
+	return b.LabelWidth + b.StatusWidth
+}
+
+// LabelX is the horizontal center of the label
+func (b badge) LabelX() int {
+	return b.LabelWidth / 2
+}
+
+// StatusX is the horizontal center of the status
+func (b badge) StatusX() int {
+	return b.LabelWidth + b.StatusWidth/2
+}
+
+// badgeRepo is what's known of a repo to serve its badges
+type badgeRepo struct {
+	public        bool
+	defaultBranch string
+	fetchedAt     time.Time
+}
+
+var (
+	badgeRepos   = map[string]badgeRepo{}
+	badgeReposMu sync.Mutex
+	// fetchBadgeRepo fetches the repo from github with the credentials its builds are reported with
+	fetchBadgeRepo = func(owner, repo string) (*github.Repository, error) {
+		return repoClient(owner, repo).Repo(vcs.GithubRequestParams{Owner: owner, Repo: repo})
+	}
+)
+
+// findBadgeRepo returns what's known of the subscribed repo, fetching it from github once it's out of date
+// Repos that can't be fetched are treated as private
+func findBadgeRepo(owner, repo string) badgeRepo {
+	project := subscriptionKey(owner, repo)
+	badgeReposMu.Lock()
+	info, ok := badgeRepos[project]
+	badgeReposMu.Unlock()
+	if ok && time.Since(info.fetchedAt) < badgeRepoTTL {
+		return info
+	}
+
+	info = badgeRepo{fetchedAt: time.Now()}
+	if r, err := fetchBadgeRepo(owner, repo); err == nil {
+		info.public = !r.GetPrivate()
+		info.defaultBranch = r.GetDefaultBranch()
+	}
+
+	badgeReposMu.Lock()
+	badgeRepos[project] = info
+	badgeReposMu.Unlock()
+	return info
+}
+
+// badgeStatus returns the status of the latest build of a push to the project's branch that produced a result
+// Skipped and cancelled builds and pull request builds are passed over. It returns unknown if there's no such build
+func badgeStatus(project, branch string) string {
+	if b := ci.LatestBranchResult(project, branch); b != nil {
+		return b.Status
+	}
+	return "unknown"
+}
+
+// badgeHandler serves the status badge of a project's branch e.g /badge/owner/repo.svg?branch=master
+// It's public so the badge can be embedded in READMEs; it's only served for subscribed public repos
+// lest it give away the builds of private ones. The branch defaults to the repo's default branch
+func badgeHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		path, _ := filepath.Rel(badgePath, r.URL.Path)
+		project := strings.TrimSuffix(path, ".svg")
+		if project == path || len(strings.Split(project, "/")) != 2 {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		// unsubscribed repos aren't looked up so made up paths don't reach github
+		parts := strings.Split(project, "/")
+		if s, err := findSubscription(parts[0], parts[1]); err != nil || s == nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		repo := findBadgeRepo(parts[0], parts[1])
+		if !repo.public {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		branch := r.URL.Query().Get("branch")
+		if branch == "" {
+			branch = repo.defaultBranch
+		}
+		if branch == "" {
+			branch = "master"
+		}
+
+		status := badgeStatus(project, branch)
+		etag := fmt.Sprintf("%q", status)
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", badgeMaxAge))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+		renderTemplate(w, "badge", newBadge(status))
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("GET"),
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
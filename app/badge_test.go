@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestBadgeHandler(t *testing.T) {
+	fetched := 0
+	defer func(f func(owner, repo string) (*github.Repository, error)) { fetchBadgeRepo = f }(fetchBadgeRepo)
+	fetchBadgeRepo = func(owner, repo string) (*github.Repository, error) {
+		fetched++
+		switch repo {
+		case "public":
+			return &github.Repository{Private: github.Bool(false), DefaultBranch: github.String("main")}, nil
+		case "private":
+			return &github.Repository{Private: github.Bool(true), DefaultBranch: github.String("main")}, nil
+		}
+		return nil, errors.New("not found")
+	}
+	for _, repo := range []string{"public", "private", "gone"} {
+		if err := saveSubscription("octocat", repo, "octocat"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		path   string
+		status int
+	}{
+		// no build has a result yet so the badge is the unknown one the client has
+		{"/badge/octocat/public.svg", http.StatusNotModified},
+		{"/badge/octocat/public.svg?branch=feature", http.StatusNotModified},
+		{"/badge/octocat/private.svg", http.StatusNotFound},
+		// repos that can't be fetched are treated as private
+		{"/badge/octocat/gone.svg", http.StatusNotFound},
+		{"/badge/octocat/unsubscribed.svg", http.StatusNotFound},
+		{"/badge/octocat.svg", http.StatusNotFound},
+	}
+
+	handler := badgeHandler()
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.Header.Set("If-None-Match", `"unknown"`)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.status {
+			t.Errorf("GET %s got %d; want %d", c.path, w.Code, c.status)
+		}
+	}
+
+	// repos are fetched once until they're out of date; unsubscribed ones never are
+	if fetched != 3 {
+		t.Errorf("repos were fetched %d times; want 3", fetched)
+	}
+	if repo := findBadgeRepo("octocat", "public"); !repo.public || repo.defaultBranch != "main" {
+		t.Errorf("findBadgeRepo(public) = %+v; want a public repo with default branch main", repo)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/0sc/sicuro/app/vcs"
+	"github.com/0sc/sicuro/store"
+)
+
+// catalogSyncInterval is how often the repo catalogs are synced with github in the background
+const catalogSyncInterval = 15 * time.Minute
+
+var (
+	// repoCatalogs holds the repos of each user that visited the dashboard keyed by login
+	repoCatalogs = store.New("repo_catalogs")
+	// catalogLocks serialize saving each user's catalog keyed by login; see catalogLock
+	catalogLocks   = map[string]*sync.Mutex{}
+	catalogLocksMu sync.Mutex
+)
+
+// repoCatalog is the local copy of a user's github repos and their subscription state the dashboard is rendered from
+// It's synced with conditional requests so unchanged repos and webhooks don't count against the rate limit
+type repoCatalog struct {
+	Login string
+	// CallbackURL is the webhook URL subscriptions are checked against; it's taken from the latest dashboard request
+	CallbackURL string
+	SyncedAt    time.Time
+	Pages       []vcs.RepoPage
+	// Subscriptions are the states of the repos' webhooks keyed by the repo's full name
+	Subscriptions map[string]*catalogSubscription
+}
+
+type catalogSubscription struct {
+	Health *vcs.SubscriptionHealth
+	// ETag is the ETag of the repo's webhook listing the health was read from
+	ETag string
+	// CheckedAt is when the health was read; a sync doesn't replace a health read after it started
+	CheckedAt time.Time
+}
+
+// catalogLock returns the lock serializing updates to the user's catalog
+// It's only held while the catalog is read and saved, never during requests to github
+func catalogLock(login string) *sync.Mutex {
+	catalogLocksMu.Lock()
+	defer catalogLocksMu.Unlock()
+
+	mu, ok := catalogLocks[login]
+	if !ok {
+		mu = &sync.Mutex{}
+		catalogLocks[login] = mu
+	}
+	return mu
+}
+
+func findCatalog(login string) (*repoCatalog, error) {
+	c := &repoCatalog{}
+	found, err := repoCatalogs.Get(login, c)
+	if err != nil || !found {
+		return nil, err
+	}
+	return c, nil
+}
+
+// syncCatalog updates the user's catalog with the user's repos and their subscription state on github
+// callbackURL replaces the catalog's CallbackURL if it isn't empty
+func syncCatalog(login, callbackURL string) (*repoCatalog, error) {
+	client, err := userClient(login)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := findCatalog(login)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		c = &repoCatalog{Login: login}
+	}
+	if callbackURL != "" && callbackURL != c.CallbackURL {
+		// the cached states were checked against another webhook URL
+		c.CallbackURL = callbackURL
+		c.Subscriptions = nil
+	}
+
+	started := time.Now()
+	if c.Pages, err = client.UserRepoPages(c.Pages); err != nil {
+		return nil, err
+	}
+
+	params := vcs.GithubRequestParams{CallbackURL: c.CallbackURL, Creds: os.Getenv("GITHUB_WEBHOOK_SECRET")}
+	subs := map[string]*catalogSubscription{}
+	for _, repo := range vcs.AdminRepos(c.Pages) {
+		name := repo.GetFullName()
+		params.Owner = repo.Owner.GetLogin()
+		params.Repo = repo.GetName()
+
+		prev := c.Subscriptions[name]
+		etag := ""
+		if prev != nil {
+			etag = prev.ETag
+		}
+
+		health, etag, err := client.CheckSubscriptionIfChanged(params, etag)
+		if err != nil {
+			// the repo keeps its last known state until its webhooks can be listed again
+			log.Printf("Error: %s occurred while checking the subscription of %s for %s\n", err, name, login)
+		}
+		if err != nil || health == nil {
+			if prev != nil {
+				subs[name] = prev
+			}
+			continue
+		}
+		subs[name] = &catalogSubscription{Health: health, ETag: etag, CheckedAt: time.Now()}
+	}
+
+	c.Subscriptions = subs
+	c.SyncedAt = time.Now()
+	return c, saveSyncedCatalog(c, started)
+}
+
+// saveSyncedCatalog saves the catalog synced since started, keeping the subscription states that were
+// refreshed while it synced e.g by subscribing to a repo from the dashboard
+func saveSyncedCatalog(c *repoCatalog, started time.Time) error {
+	mu := catalogLock(c.Login)
+	mu.Lock()
+	defer mu.Unlock()
+
+	saved, err := findCatalog(c.Login)
+	if err != nil {
+		return err
+	}
+	if saved != nil && saved.CallbackURL == c.CallbackURL {
+		for name, sub := range saved.Subscriptions {
+			if _, listed := c.Subscriptions[name]; listed && sub != nil && sub.CheckedAt.After(started) {
+				c.Subscriptions[name] = sub
+			}
+		}
+	}
+	return repoCatalogs.Put(c.Login, c)
+}
+
+// refreshCatalogSubscription updates the state of the repo's webhook in every catalog listing the repo
+// e.g after the repo is subscribed, repaired or unsubscribed from the dashboard
+func refreshCatalogSubscription(client *vcs.GithubClient, params vcs.GithubRequestParams) {
+	health, etag, err := client.CheckSubscriptionIfChanged(params, "")
+	if err != nil {
+		log.Printf("Error: %s occurred while checking the subscription of %s/%s\n", err, params.Owner, params.Repo)
+		return
+	}
+	sub := &catalogSubscription{Health: health, ETag: etag, CheckedAt: time.Now()}
+
+	logins, err := repoCatalogs.Keys()
+	if err != nil {
+		log.Println("Error occurred while listing repo catalogs: ", err)
+		return
+	}
+
+	name := params.Owner + "/" + params.Repo
+	for _, login := range logins {
+		updateCatalogSubscription(login, name, params.CallbackURL, sub)
+	}
+}
+
+// updateCatalogSubscription sets the state of the repo's webhook in the user's catalog if it lists the repo
+func updateCatalogSubscription(login, name, callbackURL string, sub *catalogSubscription) {
+	mu := catalogLock(login)
+	mu.Lock()
+	defer mu.Unlock()
+
+	c, err := findCatalog(login)
+	if err != nil || c == nil || c.CallbackURL != callbackURL {
+		return
+	}
+	if _, ok := c.Subscriptions[name]; !ok {
+		return
+	}
+
+	c.Subscriptions[name] = sub
+	if err := repoCatalogs.Put(login, c); err != nil {
+		log.Printf("Error: %s occurred while saving the repo catalog of %s\n", err, login)
+	}
+}
+
+// startCatalogSync syncs every catalog with github every catalogSyncInterval
+func startCatalogSync() {
+	go func() {
+		for range time.Tick(catalogSyncInterval) {
+			logins, err := repoCatalogs.Keys()
+			if err != nil {
+				log.Println("Error occurred while listing repo catalogs: ", err)
+				continue
+			}
+
+			for _, login := range logins {
+				if _, err := syncCatalog(login, ""); err != nil {
+					log.Printf("Error: %s occurred while syncing the repo catalog of %s\n", err, login)
+				}
+			}
+		}
+	}()
+}
+
+// catalogRepos returns the catalog's repos matching the filter along with the owners of all its repos
+func catalogRepos(c *repoCatalog, filter repoFilter) ([]repoWithSubscriptionInfo, []string) {
+	repos := []repoWithSubscriptionInfo{}
+	owners := []string{}
+	seen := map[string]bool{}
+
+	for _, repo := range vcs.AdminRepos(c.Pages) {
+		if owner := repo.Owner.GetLogin(); !seen[owner] {
+			seen[owner] = true
+			owners = append(owners, owner)
+		}
+
+		health := &vcs.SubscriptionHealth{}
+		if sub := c.Subscriptions[repo.GetFullName()]; sub != nil && sub.Health != nil {
+			health = sub.Health
+		}
+		info := repoWithSubscriptionInfo{IsSubscribed: health.Subscribed, Health: health, Repository: repo}
+		if s, _ := findSubscription(repo.Owner.GetLogin(), repo.GetName()); info.IsSubscribed && s != nil {
+			info.Subscriber = s.Login
+			info.SubscriberRevoked = s.subscriberRevoked()
+		}
+
+		if filter.matches(info) {
+			repos = append(repos, info)
+		}
+	}
+
+	sort.Strings(owners)
+	return repos, owners
+}
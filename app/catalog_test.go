@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/0sc/sicuro/app/vcs"
+)
+
+func TestSaveSyncedCatalogKeepsRefreshedSubscriptions(t *testing.T) {
+	url := "https://sicuro.example.com/gh/webhook"
+	started := time.Now()
+	if err := repoCatalogs.Put("octocat", &repoCatalog{Login: "octocat", CallbackURL: url, Subscriptions: map[string]*catalogSubscription{
+		"octocat/hello": {ETag: `"old"`},
+		"octocat/world": {ETag: `"old"`},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// octocat/world is subscribed from the dashboard while the catalog syncs
+	refreshed := &catalogSubscription{Health: &vcs.SubscriptionHealth{Subscribed: true}, ETag: `"subscribed"`, CheckedAt: time.Now()}
+	updateCatalogSubscription("octocat", "octocat/world", url, refreshed)
+
+	synced := &repoCatalog{Login: "octocat", CallbackURL: url, Subscriptions: map[string]*catalogSubscription{
+		"octocat/hello": {Health: &vcs.SubscriptionHealth{}, ETag: `"synced"`, CheckedAt: started},
+		"octocat/world": {Health: &vcs.SubscriptionHealth{}, ETag: `"synced"`, CheckedAt: started},
+	}}
+	if err := saveSyncedCatalog(synced, started); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := findCatalog("octocat")
+	if err != nil || c == nil {
+		t.Fatalf("findCatalog() = %v, %v; want the saved catalog", c, err)
+	}
+	if etag := c.Subscriptions["octocat/hello"].ETag; etag != `"synced"` {
+		t.Errorf("octocat/hello has ETag %s; want the synced state", etag)
+	}
+	if sub := c.Subscriptions["octocat/world"]; sub.ETag != `"subscribed"` || !sub.Health.Subscribed {
+		t.Errorf("octocat/world = %+v; want the state refreshed during the sync", sub)
+	}
+}
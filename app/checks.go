@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/0sc/sicuro/app/vcs"
+	"github.com/0sc/sicuro/ci"
+)
+
+var (
+	// githubApp is sicuro's github app, if one is configured
+	// Builds are reported as check runs on the repos it's installed on
+	githubApp *vcs.GithubApp
+	// commentMu serializes updating summary comments so concurrent builds don't both create one
+	commentMu sync.Mutex
+)
+
+// setupGithubApp loads the github app from GITHUB_APP_ID and the private key at GITHUB_APP_PRIVATE_KEY_PATH
+// Builds are only reported as commit statuses if they aren't set
+func setupGithubApp() {
+	id := os.Getenv("GITHUB_APP_ID")
+	keyPath := os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH")
+	if id == "" || keyPath == "" {
+		return
+	}
+
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		log.Println("Error reading the github app private key; check runs are disabled: ", err)
+		return
+	}
+
+	if githubApp, err = vcs.NewGithubApp(id, key); err != nil {
+		log.Println("Error loading the github app; check runs are disabled: ", err)
+	}
+}
+
+// setReporters sets the job's status callbacks reporting the build to github with client
+// params identify the commit built; the reports link to the build's page on host
+func setReporters(client *vcs.GithubClient, params vcs.GithubRequestParams, host string, job *ci.JobDetails) {
+	params.CallbackURL = fmt.Sprintf("http://%s%s%s", host, ciPath, job.LogFileName)
+	job.UpdateBuildStatus = buildStatusUpdater(client, params, job.LogFileName)
+	job.UpdateStepStatus = stepStatusUpdater(client, params)
+	if job.SummaryComment {
+		job.UpdateBuildStatus = withSummaryComment(job.UpdateBuildStatus, client, params, job)
+	}
+}
+
+// setWebhookReporters reports the builds of webhook events with the credentials from webhookClient
+// Builds aren't reported if there are none; the build page tells why instead
+func setWebhookReporters(job *ci.JobDetails, host, owner, repo, sha string) {
+	client, err := webhookClient(owner, repo)
+	if err != nil {
+		log.Printf("Error: %s occurred getting a github client for %s/%s; build %s won't be reported\n", err, owner, repo, job.LogFileName)
+		job.Notice = unreportedNotice(owner, repo, err)
+		return
+	}
+	setReporters(client, vcs.GithubRequestParams{Owner: owner, Repo: repo, Ref: sha}, host, job)
+}
+
+// unreportedNotice returns the notice shown on a build of the repo that can't be reported to github
+func unreportedNotice(owner, repo string, err error) string {
+	if err == errCredentialsRevoked {
+		return fmt.Sprintf("This build isn't reported to Github: the Github credentials of the user that subscribed %s/%s "+
+			"were revoked or have expired. Subscribe the repo again from the dashboard to have its builds reported", owner, repo)
+	}
+	return fmt.Sprintf("This build isn't reported to Github: %s", err)
+}
+
+// buildStatusUpdater returns the UpdateBuildStatus callback for the build with the given name
+// The build is reported as a check run when sicuro's github app is installed on the repo
+// and as a commit status using client otherwise
+func buildStatusUpdater(client *vcs.GithubClient, params vcs.GithubRequestParams, build string) func(string) {
+	statuses := client.UpdateBuildStatus(params)
+	if githubApp == nil {
+		return statuses
+	}
+
+	appClient, err := githubApp.InstallationClient(params.Owner, params.Repo)
+	if err != nil {
+		log.Printf("Error: %s occurred getting the github app client for %s/%s; reporting statuses instead\n", err, params.Owner, params.Repo)
+		return statuses
+	}
+	return appClient.UpdateBuildCheck(params, checkRunOutput(build), statuses)
+}
+
+// stepStatusUpdater returns the UpdateStepStatus callback of a build
+// Each step is reported as a commit status under its own context
+func stepStatusUpdater(client *vcs.GithubClient, params vcs.GithubRequestParams) func(string, string) {
+	return func(step, state string) {
+		client.UpdateStepStatus(params, step)(state)
+	}
+}
+
+// withSummaryComment wraps the UpdateBuildStatus callback of the job to also update
+// the summary comment on each of the pull requests linked to the build
+func withSummaryComment(update func(string), client *vcs.GithubClient, params vcs.GithubRequestParams, job *ci.JobDetails) func(string) {
+	return func(state string) {
+		update(state)
+
+		if b := ci.FindBuild(job.LogFileName); b != nil {
+			updateSummaryComments(client, params, b, job.CoverageBase, b.PullRequests())
+		}
+	}
+}
+
+// summarizeLinkedBuild posts the summary comment of the build a pull request was linked to
+// The build may have been started by another event, or have finished, so it isn't reported on the pull request otherwise
+func summarizeLinkedBuild(job *ci.JobDetails, host, owner, repo string, pr int64) {
+	b := ci.FindBuild(job.LogFileName)
+	if b == nil {
+		return
+	}
+
+	client, err := webhookClient(owner, repo)
+	if err != nil {
+		log.Printf("Error: %s occurred getting a github client for %s/%s; build %s won't be summarized on pull request #%d\n", err, owner, repo, b.Name, pr)
+		return
+	}
+	params := vcs.GithubRequestParams{
+		Owner:       owner,
+		Repo:        repo,
+		CallbackURL: fmt.Sprintf("http://%s%s%s", host, ciPath, b.Name),
+	}
+	updateSummaryComments(client, params, b, job.CoverageBase, []int64{pr})
+}
+
+// updateSummaryComments updates the summary comment of the build on each of the pull requests
+func updateSummaryComments(client *vcs.GithubClient, params vcs.GithubRequestParams, b *ci.Build, base string, prs []int64) {
+	if len(prs) == 0 {
+		return
+	}
+	summary := buildSummary(b, base, params.CallbackURL)
+
+	commentMu.Lock()
+	defer commentMu.Unlock()
+	for _, pr := range prs {
+		if err := client.UpdatePullRequestSummary(params, int(pr), summary); err != nil {
+			log.Printf("Error: %s occurred while updating the summary comment of build %s on pull request #%d\n", err, b.Name, pr)
+		}
+	}
+}
+
+// buildSummary returns the summary of the build shown on its pull requests
+// Its coverage is compared with the latest build of pushes to the base branch
+func buildSummary(b *ci.Build, base, url string) *vcs.BuildSummary {
+	summary := &vcs.BuildSummary{
+		Number:     b.Number,
+		Status:     b.Status,
+		URL:        url,
+		Coverage:   b.Coverage,
+		BaseBranch: base,
+	}
+	for _, step := range b.Steps {
+		summary.Steps = append(summary.Steps, vcs.StepSummary{Name: step.Name, Status: step.Status})
+	}
+
+	if !b.Finished() {
+		return summary
+	}
+
+	if report, err := ci.BuildReport(b.Name); err == nil {
+		for _, a := range report.Annotations {
+			if a.Level == ci.AnnotationFailure {
+				summary.Failures = append(summary.Failures, fmt.Sprintf("`%s:%d` %s", a.Path, a.Line, a.Message))
+			}
+		}
+	}
+
+	project := strings.Join(strings.SplitN(b.Name, "/", 3)[:2], "/")
+	if cov, ok := ci.BaseCoverage(project, base); ok && base != "" {
+		summary.BaseCoverage = &cov
+	}
+	return summary
+}
+
+// checkRunOutput returns the function building the check run output of the build for each of its states
+// The test summary and annotations are read from the build's log once it's finished
+func checkRunOutput(build string) func(string) *vcs.CheckRunOutput {
+	return func(state string) *vcs.CheckRunOutput {
+		out := &vcs.CheckRunOutput{Title: checkRunTitle(state)}
+
+		switch state {
+		case ci.StatusQueued, ci.StatusPending:
+			out.Summary = "Follow the build log on Sicuro"
+			return out
+		}
+
+		report, err := ci.BuildReport(build)
+		if err != nil {
+			log.Printf("Error: %s occurred while reading the report of build %s\n", err, build)
+			out.Summary = "The build log couldn't be read"
+			return out
+		}
+
+		out.Summary = "No test results were found in the build log"
+		if len(report.Summary) > 0 {
+			out.Summary = strings.Join(report.Summary, "\n\n")
+		}
+		for _, a := range report.Annotations {
+			out.Annotations = append(out.Annotations, vcs.CheckRunAnnotation{
+				Path:            a.Path,
+				StartLine:       a.Line,
+				EndLine:         a.Line,
+				AnnotationLevel: a.Level,
+				Message:         a.Message,
+			})
+		}
+		return out
+	}
+}
+
+func checkRunTitle(state string) string {
+	switch state {
+	case ci.StatusQueued:
+		return "Queued on Sicuro"
+	case ci.StatusPending:
+		return "Sicuro is running your tests"
+	case ci.StatusSuccess:
+		return "Your tests passed"
+	case ci.StatusFailure:
+		return "Your tests failed"
+	case ci.StatusCancelled:
+		return "The build was cancelled"
+	case ci.StatusSkipped:
+		return "The build was skipped"
+	}
+	return "Sicuro couldn't run your tests"
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0sc/sicuro/ci"
+)
+
+func TestSetWebhookReportersNotice(t *testing.T) {
+	if err := users.Put("revoked", user{Login: "revoked", RevokedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSubscription("octocat", "revoked", "revoked"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		repo   string
+		notice string
+	}{
+		{"revoked", "Subscribe the repo again from the dashboard"},
+		{"unsubscribed", "no subscription recorded for octocat/unsubscribed"},
+	}
+
+	for _, c := range cases {
+		job := &ci.JobDetails{LogFileName: "octocat/" + c.repo + "/builds/1"}
+		setWebhookReporters(job, "localhost", "octocat", c.repo, "6dcb09b")
+		if job.UpdateBuildStatus != nil {
+			t.Errorf("build of %s got reporters without credentials", c.repo)
+		}
+		if !strings.Contains(job.Notice, c.notice) {
+			t.Errorf("build of %s got notice %q; want it to contain %q", c.repo, job.Notice, c.notice)
+		}
+	}
+}
@@ -21,11 +21,12 @@ import (
 var (
 	sessionSecret = os.Getenv("SESSION_SECRET")
 	sessionStore  = sessions.NewCookieStore([]byte(sessionSecret))
-	templates     = template.Must(template.ParseFiles(fetchTemplates()...))
 	upgrader      = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 	}
+	// templates are parsed on start up; see loadTemplates
+	templates *template.Template
 )
 
 func wsHandler(w http.ResponseWriter, r *http.Request) {
@@ -46,7 +47,100 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func githubWebhookHandler(w http.ResponseWriter, r *http.Request) {
-	webhook.GithubWebhookHandler(r)
+	r.Body = http.MaxBytesReader(w, r.Body, webhook.MaxPayloadSize)
+	res := webhook.GithubWebhookHandler(r)
+	renderJSON(w, webhookResponseStatus(res.Outcome), res)
+}
+
+// webhookResponseStatus maps the outcome of a webhook request to the status github is sent
+// so requests github shouldn't have sent are flagged in the github hook UI. Jobs that
+// couldn't be built from a valid delivery aren't the hook's fault; they're answered with a
+// 200 and the error in the body so they don't show up as a broken webhook on the dashboard
+func webhookResponseStatus(outcome webhook.Outcome) int {
+	switch outcome {
+	case webhook.OutcomeQueued, webhook.OutcomeCoalesced, webhook.OutcomeDuplicate:
+		return http.StatusAccepted
+	case webhook.OutcomeMalformed:
+		return http.StatusBadRequest
+	case webhook.OutcomeRejected:
+		return http.StatusUnauthorized
+	}
+	return http.StatusOK
+}
+
+func webhookDeliveriesPageHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		session, _ := fetchSession(r)
+
+		info := struct {
+			FlashMsgs  []interface{}
+			Deliveries []*webhook.Delivery
+			Rejections []*webhook.Delivery
+			CSRFToken  string
+		}{
+			FlashMsgs:  session.Flashes(),
+			CSRFToken:  csrfToken(session),
+			Deliveries: webhook.Deliveries(),
+			Rejections: webhook.Rejections(),
+		}
+		session.Save(r, w)
+		renderTemplate(w, "deliveries", info)
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("GET"),
+		authenticationMiddleware,
+		adminMiddleware,
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+// webhookDeliveryPayloadHandler serves the payload of a logged webhook delivery
+// Payloads are kept apart from the delivery log so the deliveries page doesn't render them all
+func webhookDeliveryPayloadHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		payload, err := webhook.DeliveryPayload(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write([]byte(payload))
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("GET"),
+		authenticationMiddleware,
+		adminMiddleware,
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+func replayWebhookDeliveryHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		d, err := webhook.Replay(r.FormValue("id"))
+		if err != nil {
+			log.Println("Error occurred while replaying webhook delivery: ", err)
+			addFlashMsg("The delivery couldn't be replayed: "+err.Error(), w, r)
+		} else {
+			addFlashMsg(fmt.Sprintf("Replayed delivery %s: %s %s", d.ReplayOf, d.Outcome, d.Error), w, r)
+		}
+
+		http.Redirect(w, r, deliveriesPath, http.StatusSeeOther)
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("POST"),
+		authenticationMiddleware,
+		csrfMiddleware,
+		adminMiddleware,
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
 }
 
 func githubSubscriptionHandler() http.HandlerFunc {
@@ -65,21 +159,134 @@ func githubSubscriptionHandler() http.HandlerFunc {
 			Creds:       os.Getenv("GITHUB_WEBHOOK_SECRET"),
 		}
 
+		login := r.Context().Value(loginCtxKey).(string)
 		err := client.Subscribe(payload)
 		if err != nil {
 			log.Println("Error while creating webhook", err)
 			session.AddFlash("An error occurred. The project might have already been subscribed.")
+			// claim repos subscribed before subscriptions were recorded,
+			// and repos whose subscriber's credentials were revoked
+			if s, _ := findSubscription(owner, project); (s == nil || s.subscriberRevoked()) && client.IsRepoSubscribed(payload) {
+				recordSubscription(owner, project, login)
+			}
 		} else {
 			session.AddFlash("Sicro is now watching: ", project)
 			redirPath = fmt.Sprintf("%s?project=%s&owner=%s", showPath, project, owner)
+			recordSubscription(owner, project, login)
 		}
 
+		refreshCatalogSubscription(client, payload)
 		session.Save(r, w)
 		http.Redirect(w, r, redirPath, http.StatusTemporaryRedirect)
 	}
 
 	middlewares := []middleware{
 		authenticationMiddleware,
+		requireScope(scopeSubscribe),
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+// githubRepairSubscriptionHandler updates the sicuro webhook on the repo in place so it delivers what sicuro needs
+func githubRepairSubscriptionHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		project := r.URL.Query().Get("project")
+		owner := r.URL.Query().Get("owner")
+		login := r.Context().Value(loginCtxKey).(string)
+		token := r.Context().Value(accessTokenCtxKey).(string)
+		client := newGithubClient(token)
+
+		payload := vcs.GithubRequestParams{
+			Owner:       owner,
+			Repo:        project,
+			CallbackURL: ghCallbackURL(r.Host),
+			Creds:       os.Getenv("GITHUB_WEBHOOK_SECRET"),
+		}
+
+		if err := client.RepairSubscription(payload); err != nil {
+			addFlashMsg("An error occurred while repairing the webhook. Please confirm that you can administer the project.", w, r)
+			http.Redirect(w, r, dashboardPath, http.StatusSeeOther)
+			return
+		}
+
+		if s, _ := findSubscription(owner, project); s == nil || s.subscriberRevoked() {
+			recordSubscription(owner, project, login)
+		}
+		refreshCatalogSubscription(client, payload)
+		addFlashMsg("The webhook of "+owner+"/"+project+" has been repaired.", w, r)
+		http.Redirect(w, r, dashboardPath, http.StatusSeeOther)
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("POST"),
+		authenticationMiddleware,
+		csrfMiddleware,
+		requireScope(scopeSubscribe),
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+// githubUnsubscriptionHandler removes the sicuro webhook from the repo and stops its builds
+// The history form value decides what happens to the project's builds and logs: they're kept by default,
+// moved out of the project's history with archive, or removed with delete
+func githubUnsubscriptionHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		project := r.URL.Query().Get("project")
+		owner := r.URL.Query().Get("owner")
+		token := r.Context().Value(accessTokenCtxKey).(string)
+		client := newGithubClient(token)
+		name := owner + "/" + project
+
+		payload := vcs.GithubRequestParams{
+			Owner:       owner,
+			Repo:        project,
+			CallbackURL: ghCallbackURL(r.Host),
+		}
+
+		if _, err := client.Unsubscribe(payload); err != nil {
+			addFlashMsg("An error occurred while removing the webhook. Please confirm that you can administer the project.", w, r)
+			http.Redirect(w, r, dashboardPath, http.StatusSeeOther)
+			return
+		}
+
+		refreshCatalogSubscription(client, payload)
+		if err := deleteSubscription(owner, project); err != nil {
+			log.Printf("Error: %s occurred while deleting the subscription of %s\n", err, name)
+		}
+		if cancelled := ci.CancelProject(name); len(cancelled) > 0 {
+			log.Printf("Cancelled builds %v of unsubscribed project %s\n", cancelled, name)
+		}
+
+		msg := "Sicuro is no longer watching: " + name
+		switch r.FormValue("history") {
+		case "archive":
+			if dir, err := ci.ArchiveProject(name); err != nil {
+				log.Printf("Error: %s occurred while archiving the builds of %s\n", err, name)
+				msg += ". Its builds couldn't be archived."
+			} else {
+				log.Printf("Archived the builds of %s to %s\n", name, dir)
+				msg += ". Its builds have been archived."
+			}
+		case "delete":
+			if err := ci.DeleteProject(name); err != nil {
+				log.Printf("Error: %s occurred while deleting the builds of %s\n", err, name)
+				msg += ". Its builds couldn't be deleted."
+			} else {
+				msg += ". Its builds have been deleted."
+			}
+		}
+
+		addFlashMsg(msg, w, r)
+		http.Redirect(w, r, dashboardPath, http.StatusSeeOther)
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("POST"),
+		authenticationMiddleware,
+		csrfMiddleware,
+		requireScope(scopeSubscribe),
 	}
 
 	return buildMiddlewareChain(self, middlewares...)
@@ -103,6 +310,17 @@ func ciPageHandler() http.HandlerFunc {
 		projectPath, _ := filepath.Rel(ciPath, r.URL.Path)
 		details := strings.Split(projectPath, "/")
 
+		commit := details[len(details)-1]
+		notifications := session.Flashes()
+		if b := ci.FindBuild(projectPath); b != nil {
+			if b.Commit != "" {
+				commit = b.Commit
+			}
+			if b.Notice != "" {
+				notifications = append(notifications, b.Notice)
+			}
+		}
+
 		var v = struct {
 			Owner         string
 			Project       string
@@ -115,12 +333,12 @@ func ciPageHandler() http.HandlerFunc {
 		}{
 			Owner:         details[0],
 			Project:       details[1],
-			Commit:        details[2],
+			Commit:        commit,
 			Host:          r.Host,
 			Data:          template.HTML(p),
 			LastMod:       strconv.FormatInt(lastMod.UnixNano(), 16),
 			ProjectPath:   projectPath,
-			Notifications: session.Flashes(),
+			Notifications: notifications,
 		}
 		renderTemplate(w, "ci", &v)
 	}
@@ -134,16 +352,42 @@ func ciPageHandler() http.HandlerFunc {
 
 func dashboardPageHandler() http.HandlerFunc {
 	self := func(w http.ResponseWriter, r *http.Request) {
-		token := r.Context().Value(accessTokenCtxKey).(string)
-		repos := getUserProjectsWithSubscriptionInfo(token, ghCallbackURL(r.Host))
+		login := r.Context().Value(loginCtxKey).(string)
+		query := r.URL.Query()
+		filter := repoFilter{Query: query.Get("q"), Owner: query.Get("owner"), State: query.Get("state")}
+
+		// the dashboard is rendered from the catalog; it's only synced here on the user's first visit
+		catalog, err := findCatalog(login)
+		if err == nil && (catalog == nil || catalog.CallbackURL != ghCallbackURL(r.Host)) {
+			catalog, err = syncCatalog(login, ghCallbackURL(r.Host))
+		}
+		if err != nil {
+			log.Printf("Error: %s occurred while loading the repo catalog of %s\n", err, login)
+			catalog = &repoCatalog{}
+		}
+		repos, owners := catalogRepos(catalog, filter)
 		session, _ := fetchSession(r)
 
 		info := struct {
-			FlashMsgs []interface{}
-			Repos     []repoWithSubscriptionInfo
+			FlashMsgs  []interface{}
+			SyncedAt   time.Time
+			RepoGroups []repoGroup
+			Owners     []string
+			States     []string
+			Filter     repoFilter
+			APITokens  []apiToken
+			APIScopes  []string
+			CSRFToken  string
 		}{
-			FlashMsgs: session.Flashes(),
-			Repos:     repos,
+			FlashMsgs:  session.Flashes(),
+			SyncedAt:   catalog.SyncedAt,
+			RepoGroups: groupRepos(repos, login),
+			Owners:     owners,
+			States:     repoStates,
+			Filter:     filter,
+			APITokens:  userAPITokens(login),
+			APIScopes:  apiScopes,
+			CSRFToken:  csrfToken(session),
 		}
 		session.Save(r, w)
 		renderTemplate(w, "dashboard", info)
@@ -152,6 +396,90 @@ func dashboardPageHandler() http.HandlerFunc {
 	middlewares := []middleware{
 		validateRequestMethod("GET"),
 		authenticationMiddleware,
+		requireScope(scopeRead),
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+// refreshCatalogHandler syncs the user's repo catalog with github instead of waiting for the background sync
+func refreshCatalogHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		login := r.Context().Value(loginCtxKey).(string)
+
+		if _, err := syncCatalog(login, ghCallbackURL(r.Host)); err != nil {
+			log.Printf("Error: %s occurred while syncing the repo catalog of %s\n", err, login)
+			addFlashMsg("We couldn't refresh your repos from Github. Please try again.", w, r)
+		}
+
+		http.Redirect(w, r, dashboardPath, http.StatusSeeOther)
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("POST"),
+		authenticationMiddleware,
+		csrfMiddleware,
+		requireScope(scopeRead),
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+func createAPITokenHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		login := r.Context().Value(loginCtxKey).(string)
+		r.ParseForm()
+
+		name := strings.TrimSpace(r.PostForm.Get("name"))
+		scopes := validAPIScopes(r.PostForm["scopes"])
+		if name == "" || len(scopes) == 0 {
+			addFlashMsg("A token needs a name and at least one scope.", w, r)
+			http.Redirect(w, r, dashboardPath, http.StatusSeeOther)
+			return
+		}
+
+		plain, _, err := mintAPIToken(login, name, scopes)
+		if err != nil {
+			log.Println("Error occurred while minting API token: ", err)
+			addFlashMsg("An error occurred while creating your token. Please try again.", w, r)
+			http.Redirect(w, r, dashboardPath, http.StatusSeeOther)
+			return
+		}
+
+		// the token is only ever rendered in this response; the session cookie isn't encrypted
+		w.Header().Set("Cache-Control", "no-store")
+		renderTemplate(w, "token", struct{ Name, Token string }{name, plain})
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("POST"),
+		authenticationMiddleware,
+		csrfMiddleware,
+		requireScope(scopeManageTokens),
+	}
+
+	return buildMiddlewareChain(self, middlewares...)
+}
+
+func revokeAPITokenHandler() http.HandlerFunc {
+	self := func(w http.ResponseWriter, r *http.Request) {
+		login := r.Context().Value(loginCtxKey).(string)
+
+		if err := revokeAPIToken(login, r.FormValue("id")); err != nil {
+			log.Println("Error occurred while revoking API token: ", err)
+			addFlashMsg("We couldn't revoke that token. It might have already been revoked.", w, r)
+		} else {
+			addFlashMsg("The token has been revoked.", w, r)
+		}
+
+		http.Redirect(w, r, dashboardPath, http.StatusSeeOther)
+	}
+
+	middlewares := []middleware{
+		validateRequestMethod("POST"),
+		authenticationMiddleware,
+		csrfMiddleware,
+		requireScope(scopeManageTokens),
 	}
 
 	return buildMiddlewareChain(self, middlewares...)
@@ -176,20 +504,51 @@ func indexPageHandler() http.HandlerFunc {
 
 func showPageHandler() http.HandlerFunc {
 	self := func(w http.ResponseWriter, r *http.Request) {
-		project := r.URL.Query().Get("project")
-		owner := r.URL.Query().Get("owner")
-		logDir := filepath.Join(ci.LogDIR, owner, project)
+		params := r.URL.Query()
+		project := fmt.Sprintf("%s/%s", params.Get("owner"), params.Get("project"))
+		filter := ci.BuildFilter{Branch: params.Get("branch"), Status: params.Get("status")}
+
+		page, _ := strconv.Atoi(params.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		history := ci.ProjectBuilds(project, filter)
+		start, end := paginate(len(history), page, buildsPerPage)
 
-		logs := listProjectLogsInDir(logDir)
 		info := struct {
-			Logs []projectLogListing
-		}{logs}
+			Owner            string
+			Repo             string
+			Project          string
+			Builds           []*ci.Build
+			Filter           ci.BuildFilter
+			Branches         []string
+			Statuses         []string
+			PrevURL          string
+			NextURL          string
+			ArchivedBranches []ci.Branch
+		}{
+			Owner:            params.Get("owner"),
+			Repo:             params.Get("project"),
+			Project:          project,
+			Builds:           history[start:end],
+			Filter:           filter,
+			Branches:         projectBranches(project),
+			Statuses:         buildStatuses,
+			ArchivedBranches: ci.ArchivedBranches(project),
+		}
+		if page > 1 {
+			info.PrevURL = pageURL(r, page-1)
+		}
+		if end < len(history) {
+			info.NextURL = pageURL(r, page+1)
+		}
 		renderTemplate(w, "show", info)
 	}
 
 	middlewares := []middleware{
 		validateRequestMethod("GET"),
 		authenticationMiddleware,
+		requireScope(scopeRead),
 		authorizationMiddleware,
 		projectSubscriptionMiddleware,
 	}
@@ -199,24 +558,7 @@ func showPageHandler() http.HandlerFunc {
 
 func runCIHandler() http.HandlerFunc {
 	self := func(w http.ResponseWriter, r *http.Request) {
-		params := r.URL.Query()
-		repo := params.Get("repo")
-		redirectURL := fmt.Sprintf("ci/%s", repo)
-
-		payload := vcs.GithubRequestParams{
-			Repo:        params.Get("project"),
-			Owner:       params.Get("owner"),
-			Ref:         params.Get("sha"),
-			CallbackURL: fmt.Sprintf("http://%s/%s", r.Host, redirectURL),
-		}
-
-		lang := params.Get("language")
-		url := params.Get("url")
-		token := r.Context().Value(accessTokenCtxKey).(string)
-
-		updateBuildStatusFunc := newGithubClient(token).UpdateBuildStatus(payload)
-
-		webhook.ManualTrigger(payload.Repo, payload.Owner, payload.Ref, lang, url, updateBuildStatusFunc)
+		redirectURL := fmt.Sprintf("ci/%s", triggerBuild(r))
 		http.Redirect(w, r, redirectURL, 302)
 	}
 
@@ -224,9 +566,32 @@ func runCIHandler() http.HandlerFunc {
 		validateRequestMethod("GET"),
 		parseProjectDetailsMiddleware,
 		authenticationMiddleware,
+		requireScope(scopeBuild),
 		authorizationMiddleware,
 		projectSubscriptionMiddleware,
 	}
 
 	return buildMiddlewareChain(self, middlewares...)
 }
+
+// triggerBuild starts a build for the project details in the request
+// It returns the name of the build
+func triggerBuild(r *http.Request) string {
+	params := r.URL.Query()
+
+	payload := vcs.GithubRequestParams{
+		Repo:  params.Get("project"),
+		Owner: params.Get("owner"),
+		Ref:   params.Get("sha"),
+	}
+
+	lang := params.Get("language")
+	url := params.Get("url")
+	token := r.Context().Value(accessTokenCtxKey).(string)
+
+	reporters := func(job *ci.JobDetails) {
+		setReporters(newGithubClient(token), payload, r.Host, job)
+	}
+
+	return webhook.ManualTrigger(payload.Repo, payload.Owner, payload.Ref, lang, url, reporters)
+}
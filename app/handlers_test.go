@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/0sc/sicuro/app/webhook"
+)
+
+func TestWebhookResponseStatus(t *testing.T) {
+	cases := []struct {
+		outcome webhook.Outcome
+		status  int
+	}{
+		{webhook.OutcomeQueued, http.StatusAccepted},
+		{webhook.OutcomeCoalesced, http.StatusAccepted},
+		{webhook.OutcomeDuplicate, http.StatusAccepted},
+		{webhook.OutcomeIgnored, http.StatusOK},
+		// a job that can't be built isn't a broken hook
+		{webhook.OutcomeError, http.StatusOK},
+		{webhook.OutcomeMalformed, http.StatusBadRequest},
+		{webhook.OutcomeRejected, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		if got := webhookResponseStatus(c.outcome); got != c.status {
+			t.Errorf("webhookResponseStatus(%s) = %d; want %d", c.outcome, got, c.status)
+		}
+	}
+}
@@ -19,7 +19,12 @@ var (
 )
 
 func main() {
+	loadTemplates()
 	setupGithubOAuth()
+	setupVault()
+	setupGithubApp()
+	setupWebhook()
+	startCatalogSync()
 	registerRoutes()
 
 	fmt.Printf("Starting server on port: %s\n", port)
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/0sc/sicuro/ci"
+	"golang.org/x/oauth2"
 )
 
 type ctxKey string
@@ -15,6 +18,11 @@ type middleware func(http.HandlerFunc) http.HandlerFunc
 
 const accessTokenKey = "AccessToken"
 const accessTokenCtxKey ctxKey = accessTokenKey
+const loginKey = "Login"
+const loginCtxKey ctxKey = loginKey
+const scopesCtxKey ctxKey = "Scopes"
+const csrfTokenKey = "CSRFToken"
+const csrfFormField = "csrf_token"
 
 func buildMiddlewareChain(f http.HandlerFunc, m ...middleware) http.HandlerFunc {
 	if len(m) == 0 {
@@ -39,18 +47,147 @@ func validateRequestMethod(mtd string) middleware {
 
 func authenticationMiddleware(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			authenticateBearerToken(f, auth, w, r)
+			return
+		}
+
+		if isAPIRequest(r) {
+			renderJSONError(w, http.StatusUnauthorized, "An API token is required")
+			return
+		}
+
 		session, err := fetchSession(r)
 		if err != nil {
 			http.Redirect(w, r, indexPath, http.StatusTemporaryRedirect)
 			return
 		}
 
-		if tkn, ok := session.Values[accessTokenKey]; !ok {
+		login, ok := session.Values[loginKey].(string)
+		if legacyTkn, found := session.Values[accessTokenKey].(string); found {
+			// sessions created before tokens were kept server side
+			if !ok {
+				if login, err = newGithubClient(legacyTkn).Username(); err != nil {
+					http.Redirect(w, r, ghAuthPath, 302)
+					return
+				}
+				if err := saveUser(login, &oauth2.Token{AccessToken: legacyTkn}); err != nil {
+					// the session keeps the token so the migration can be retried on the next request
+					log.Printf("Error: %s occurred while migrating the session of %s\n", err, login)
+					serveWithToken(f, w, r, login, legacyTkn)
+					return
+				}
+				session.Values[loginKey] = login
+				ok = true
+			}
+			delete(session.Values, accessTokenKey)
+			session.Save(r, w)
+		}
+		if !ok {
 			http.Redirect(w, r, ghAuthPath, 302)
-		} else {
-			ctx := context.WithValue(r.Context(), accessTokenCtxKey, tkn.(string))
-			f.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		tkn, err := userToken(login)
+		if err != nil {
+			log.Printf("Error: %s occurred while fetching the github token of %s\n", err, login)
+			http.Redirect(w, r, ghAuthPath, 302)
+			return
+		}
+
+		serveWithToken(f, w, r, login, tkn)
+	}
+}
+
+// serveWithToken serves the request of a signed in user acting with the github token
+func serveWithToken(f http.HandlerFunc, w http.ResponseWriter, r *http.Request, login, tkn string) {
+	ctx := context.WithValue(r.Context(), accessTokenCtxKey, tkn)
+	ctx = context.WithValue(ctx, loginCtxKey, login)
+	ctx = context.WithValue(ctx, scopesCtxKey, sessionScopes)
+	f.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// csrfMiddleware rejects state changing requests of signed in users that don't carry the session's CSRF token
+// in the csrf_token form field; see csrfToken. Requests authenticated with an API token are let through
+// as browsers don't send those on their own
+func csrfMiddleware(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Header.Get("Authorization") != "" {
+			f.ServeHTTP(w, r)
+			return
 		}
+
+		session, err := fetchSession(r)
+		want, _ := session.Values[csrfTokenKey].(string)
+		got := r.FormValue(csrfFormField)
+		if err != nil || want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			http.Error(w, "Invalid or missing CSRF token; reload the page and try again", http.StatusForbidden)
+			return
+		}
+		f.ServeHTTP(w, r)
+	}
+}
+
+func authenticateBearerToken(f http.HandlerFunc, auth string, w http.ResponseWriter, r *http.Request) {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		http.Error(w, "Unsupported authorization scheme", http.StatusUnauthorized)
+		return
+	}
+
+	tkn, err := authenticateAPIToken(strings.TrimPrefix(auth, prefix))
+	if err != nil {
+		http.Error(w, "Invalid API token", http.StatusUnauthorized)
+		return
+	}
+
+	u, err := findUser(tkn.Login)
+	if err != nil {
+		log.Printf("Error: %s occurred while looking up owner of API token %s\n", err, tkn.Hint)
+		http.Error(w, "Invalid API token", http.StatusUnauthorized)
+		return
+	}
+
+	accessTkn, err := userToken(u.Login)
+	if err != nil {
+		log.Printf("Error: %s occurred while fetching the github token of %s\n", err, u.Login)
+		http.Error(w, "Sicuro can no longer access github as the token's owner; sign in again", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), accessTokenCtxKey, accessTkn)
+	ctx = context.WithValue(ctx, loginCtxKey, u.Login)
+	ctx = context.WithValue(ctx, scopesCtxKey, tkn.Scopes)
+	f.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func requireScope(scope string) middleware {
+	mware := func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			scopes, _ := r.Context().Value(scopesCtxKey).([]string)
+			if !hasScope(scopes, scope) {
+				http.Error(w, "Token is missing the required scope: "+scope, http.StatusForbidden)
+				return
+			}
+			f.ServeHTTP(w, r)
+		}
+	}
+
+	return mware
+}
+
+// adminMiddleware only lets through users listed in the SICURO_ADMINS env variable
+func adminMiddleware(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login, _ := r.Context().Value(loginCtxKey).(string)
+		for _, admin := range strings.Split(os.Getenv("SICURO_ADMINS"), ",") {
+			if admin = strings.TrimSpace(admin); admin != "" && admin == login {
+				f.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		http.Error(w, "Not found", http.StatusNotFound)
 	}
 }
 
@@ -63,8 +200,7 @@ func authorizationMiddleware(f http.HandlerFunc) http.HandlerFunc {
 		repo, err := getProject(accessTkn, owner, project)
 		if err != nil {
 			flashMsg := "An error occurred while looking up the project. Please confirm that the project exists"
-			addFlashMsg(flashMsg, w, r)
-			http.Redirect(w, r, dashboardPath, http.StatusTemporaryRedirect)
+			rejectRequest(w, r, http.StatusNotFound, flashMsg, http.StatusTemporaryRedirect)
 			return
 		}
 
@@ -85,9 +221,7 @@ func projectSubscriptionMiddleware(f http.HandlerFunc) http.HandlerFunc {
 
 		if _, err := os.Stat(logDir); err != nil {
 			flashMsg := "Oops! Looks like the project is not subscribed. Please subscribe and try again."
-			addFlashMsg(flashMsg, w, r)
-
-			http.Redirect(w, r, dashboardPath, 302)
+			rejectRequest(w, r, http.StatusNotFound, flashMsg, 302)
 			return
 		}
 
@@ -104,7 +238,7 @@ func parseProjectDetailsMiddleware(f http.HandlerFunc) http.HandlerFunc {
 		values := r.URL.Query()
 
 		if len(details) > len(attrs) {
-			http.Redirect(w, r, dashboardPath, 302)
+			rejectRequest(w, r, http.StatusBadRequest, "", 302)
 			return
 		}
 
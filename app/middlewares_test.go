@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	// a signed in user's session cookie holding a CSRF token
+	page := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", dashboardPath, nil)
+	session, _ := fetchSession(req)
+	tkn := csrfToken(session)
+	if err := session.Save(req, page); err != nil {
+		t.Fatal(err)
+	}
+	cookie := page.Header().Get("Set-Cookie")
+
+	cases := []struct {
+		desc   string
+		form   url.Values
+		cookie string
+		auth   string
+		status int
+	}{
+		{"matching token", url.Values{csrfFormField: {tkn}}, cookie, "", http.StatusOK},
+		{"missing token", url.Values{}, cookie, "", http.StatusForbidden},
+		{"wrong token", url.Values{csrfFormField: {tkn + "x"}}, cookie, "", http.StatusForbidden},
+		{"token without a session", url.Values{csrfFormField: {tkn}}, "", "", http.StatusForbidden},
+		{"API token", url.Values{}, "", "Bearer sicuro_token", http.StatusOK},
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", revokeTokenPath, strings.NewReader(c.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.cookie != "" {
+			r.Header.Set("Cookie", c.cookie)
+		}
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+
+		w := httptest.NewRecorder()
+		csrfMiddleware(ok)(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: got %d; want %d", c.desc, w.Code, c.status)
+		}
+	}
+}
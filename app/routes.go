@@ -6,16 +6,29 @@ import (
 )
 
 const (
-	runCIPath       = "/run"
-	showPath        = "/show"
-	indexPath       = "/index"
-	dashboardPath   = "/dashboard"
-	ciPath          = "/ci/"
-	ghAuthPath      = "/gh/auth"
-	ghSubscribePath = "/gh/subscribe"
-	ghCallbackPath  = "/gh/callback"
-	ghWebhookPath   = "/gh/webhook"
-	websocketPath   = "/ws/"
+	runCIPath         = "/run"
+	showPath          = "/show"
+	indexPath         = "/index"
+	dashboardPath     = "/dashboard"
+	refreshReposPath  = "/dashboard/refresh"
+	tokensPath        = "/tokens"
+	revokeTokenPath   = "/tokens/revoke"
+	ciPath            = "/ci/"
+	ghAuthPath        = "/gh/auth"
+	ghSubscribePath   = "/gh/subscribe"
+	ghUnsubscribePath = "/gh/unsubscribe"
+	ghRepairPath      = "/gh/repair"
+	ghCallbackPath    = "/gh/callback"
+	ghWebhookPath     = "/gh/webhook"
+	websocketPath     = "/ws/"
+	deliveriesPath    = "/admin/deliveries"
+	replayPath        = "/admin/deliveries/replay"
+	payloadPath       = "/admin/deliveries/payload"
+	apiPath           = "/api/"
+	apiBuildsPath     = "/api/builds"
+	apiRunPath        = "/api/run"
+	apiLogsPath       = "/api/logs/"
+	badgePath         = "/badge/"
 )
 
 var ghCallbackURL = func(hostAddr string) string {
@@ -28,13 +41,26 @@ func registerRoutes() {
 	http.HandleFunc(showPath, showPageHandler())
 	http.HandleFunc(indexPath, indexPageHandler())
 	http.HandleFunc(dashboardPath, dashboardPageHandler())
+	http.HandleFunc(refreshReposPath, refreshCatalogHandler())
 	http.HandleFunc(ghSubscribePath, githubSubscriptionHandler())
+	http.HandleFunc(ghUnsubscribePath, githubUnsubscriptionHandler())
+	http.HandleFunc(ghRepairPath, githubRepairSubscriptionHandler())
+	http.HandleFunc(tokensPath, createAPITokenHandler())
+	http.HandleFunc(revokeTokenPath, revokeAPITokenHandler())
 
 	http.HandleFunc(websocketPath, wsHandler)
+	http.HandleFunc(badgePath, badgeHandler())
+
+	http.HandleFunc(apiBuildsPath, apiBuildsHandler())
+	http.HandleFunc(apiRunPath, apiRunHandler())
+	http.HandleFunc(apiLogsPath, apiLogsHandler())
 
 	http.HandleFunc(ghAuthPath, ghAuthHandler)
 	http.HandleFunc(ghCallbackPath, ghAuthCallbackHandler)
 	http.HandleFunc(ghWebhookPath, githubWebhookHandler)
+	http.HandleFunc(deliveriesPath, webhookDeliveriesPageHandler())
+	http.HandleFunc(replayPath, replayWebhookDeliveryHandler())
+	http.HandleFunc(payloadPath, webhookDeliveryPayloadHandler())
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, indexPath, http.StatusPermanentRedirect)
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/0sc/sicuro/app/vcs"
+	"github.com/0sc/sicuro/store"
+)
+
+var subscriptions = store.New("subscriptions")
+
+// subscription is the record of the user that subscribed a repo to sicuro
+// Their github credentials are used to act on the repo for builds started by webhooks
+type subscription struct {
+	// Repo is of the form owner/repo
+	Repo      string
+	Login     string
+	CreatedAt time.Time
+}
+
+func subscriptionKey(owner, repo string) string {
+	return owner + "/" + repo
+}
+
+func saveSubscription(owner, repo, login string) error {
+	s := subscription{Repo: subscriptionKey(owner, repo), Login: login, CreatedAt: time.Now()}
+	return subscriptions.Put(s.Repo, s)
+}
+
+// recordSubscription saves the subscription, logging any error
+// Builds of the repo's webhook events aren't reported without it
+func recordSubscription(owner, repo, login string) {
+	if err := saveSubscription(owner, repo, login); err != nil {
+		log.Printf("Error: %s occurred while recording the subscription of %s/%s by %s\n", err, owner, repo, login)
+	}
+}
+
+func deleteSubscription(owner, repo string) error {
+	return subscriptions.Delete(subscriptionKey(owner, repo))
+}
+
+// findSubscription returns the subscription of the repo or nil if it isn't known
+func findSubscription(owner, repo string) (*subscription, error) {
+	s := &subscription{}
+	found, err := subscriptions.Get(subscriptionKey(owner, repo), s)
+	if err != nil || !found {
+		return nil, err
+	}
+	return s, nil
+}
+
+// subscriberGithubClient returns a github client acting as the user that subscribed the repo
+func subscriberGithubClient(owner, repo string) (*vcs.GithubClient, error) {
+	s, err := findSubscription(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("no subscription recorded for %s/%s", owner, repo)
+	}
+	return userClient(s.Login)
+}
+
+// subscriberRevoked returns true if the credentials of the user that subscribed the repo can't be used anymore
+func (s *subscription) subscriberRevoked() bool {
+	u, err := findUser(s.Login)
+	return err != nil || u.Revoked()
+}
+
+// repoClient returns a github client that can read the repo's content, private or not, for webhook builds
+// It falls back to an unauthenticated client, which can only read public repos, if webhookClient has no credentials
+func repoClient(owner, repo string) *vcs.GithubClient {
+	client, err := webhookClient(owner, repo)
+	if err != nil {
+		log.Printf("Error: %s occurred fetching credentials for %s/%s; accessing it unauthenticated\n", err, owner, repo)
+		return newGithubClient("")
+	}
+	return client
+}
+
+// webhookClient returns the github client reporting builds of webhook events on the repo
+// i.e sicuro's github app installation on the repo if there's one, or else the subscriber's credentials
+func webhookClient(owner, repo string) (*vcs.GithubClient, error) {
+	if githubApp != nil {
+		client, err := githubApp.InstallationClient(owner, repo)
+		if err == nil {
+			return client, nil
+		}
+		log.Printf("Error: %s occurred getting the github app client for %s/%s; using the subscriber's credentials\n", err, owner, repo)
+	}
+
+	return subscriberGithubClient(owner, repo)
+}
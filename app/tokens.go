@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0sc/sicuro/app/vcs"
+	"github.com/0sc/sicuro/store"
+	"golang.org/x/oauth2"
+)
+
+const (
+	apiTokenPrefix = "sicuro_"
+	// apiTokenUsageResolution is how stale the recorded last use of an API token can get
+	apiTokenUsageResolution = time.Minute
+
+	// scopeRead allows viewing projects and their build logs
+	scopeRead = "read"
+	// scopeBuild allows triggering builds
+	scopeBuild = "build"
+	// scopeSubscribe allows subscribing repos to sicuro
+	scopeSubscribe = "subscribe"
+	// scopeManageTokens allows minting and revoking API tokens.
+	// It's only ever granted to browser sessions
+	scopeManageTokens = "tokens"
+)
+
+var (
+	// apiScopes are the scopes that can be granted to an API token
+	apiScopes = []string{scopeRead, scopeBuild, scopeSubscribe}
+	// sessionScopes are the scopes granted to a signed in browser session
+	sessionScopes = append([]string{scopeManageTokens}, apiScopes...)
+
+	users     = store.New("users")
+	apiTokens = store.New("api_tokens")
+
+	errInvalidAPIToken    = errors.New("invalid API token")
+	errCredentialsRevoked = errors.New("github credentials were revoked or have expired")
+
+	// userMu serializes reading and refreshing users' github tokens; github refresh tokens can only be used once
+	userMu sync.Mutex
+)
+
+// user is the server side record of a user that signed in with github
+type user struct {
+	Login string
+	// AccessToken is the plaintext token of records saved before tokens were encrypted; see rotateUserTokens
+	AccessToken string `json:",omitempty"`
+	// Token and RefreshToken are sealed by the credentials vault
+	Token        string
+	RefreshToken string `json:",omitempty"`
+	// Expiry is when Token expires; it's zero for tokens that don't expire
+	Expiry time.Time
+	// RevokedAt is when github rejected the user's token; it's cleared when they sign in again
+	RevokedAt time.Time
+}
+
+// Revoked returns true if sicuro can no longer act on github as the user
+func (u *user) Revoked() bool {
+	return !u.RevokedAt.IsZero()
+}
+
+// apiToken is a personal access token for non-browser clients
+// Only the hash of the token is stored; the token itself is shown to the user once
+type apiToken struct {
+	ID         string
+	Name       string
+	Login      string
+	Scopes     []string
+	Hint       string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+func saveUser(login string, tkn *oauth2.Token) error {
+	u := user{Login: login, Expiry: tkn.Expiry}
+	if err := u.seal(tkn); err != nil {
+		return err
+	}
+	return users.Put(login, u)
+}
+
+func (u *user) seal(tkn *oauth2.Token) (err error) {
+	if u.Token, err = credentials.seal(tkn.AccessToken); err != nil {
+		return err
+	}
+	u.RefreshToken = ""
+	if tkn.RefreshToken != "" {
+		u.RefreshToken, err = credentials.seal(tkn.RefreshToken)
+	}
+	return err
+}
+
+func (u *user) token() (*oauth2.Token, error) {
+	access, err := credentials.open(u.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	tkn := &oauth2.Token{AccessToken: access, Expiry: u.Expiry}
+	if u.RefreshToken != "" {
+		if tkn.RefreshToken, err = credentials.open(u.RefreshToken); err != nil {
+			return nil, err
+		}
+	}
+	return tkn, nil
+}
+
+// userToken returns the user's github access token, refreshing it first if it has expired
+// It returns errCredentialsRevoked if the token can't be used anymore; the user has to sign in again
+func userToken(login string) (string, error) {
+	userMu.Lock()
+	defer userMu.Unlock()
+
+	u, err := findUser(login)
+	if err != nil {
+		return "", err
+	}
+	if u.Revoked() {
+		return "", errCredentialsRevoked
+	}
+
+	tkn, err := u.token()
+	if err != nil {
+		log.Printf("Error: %s occurred while decrypting the github token of %s\n", err, login)
+		flagRevoked(u)
+		return "", errCredentialsRevoked
+	}
+	if tkn.Valid() {
+		return tkn.AccessToken, nil
+	}
+
+	if tkn.RefreshToken == "" {
+		flagRevoked(u)
+		return "", errCredentialsRevoked
+	}
+	refreshed, err := githubOAuth.TokenSource(oauth2.NoContext, tkn).Token()
+	if err != nil {
+		log.Printf("Error: %s occurred while refreshing the github token of %s\n", err, login)
+		flagRevoked(u)
+		return "", errCredentialsRevoked
+	}
+	if err := saveUser(login, refreshed); err != nil {
+		log.Printf("Error: %s occurred while saving the refreshed github token of %s\n", err, login)
+	}
+	return refreshed.AccessToken, nil
+}
+
+// userClient returns a github client acting as the user
+// The user's credentials are flagged as revoked if github rejects them
+func userClient(login string) (*vcs.GithubClient, error) {
+	token, err := userToken(login)
+	if err != nil {
+		return nil, err
+	}
+
+	return vcs.NewGithubUserClient(token, func() {
+		userMu.Lock()
+		defer userMu.Unlock()
+
+		if u, err := findUser(login); err == nil && !u.Revoked() {
+			flagRevoked(u)
+		}
+	}), nil
+}
+
+// flagRevoked records that the user's github token can't be used anymore
+func flagRevoked(u *user) {
+	log.Printf("The github credentials of %s were revoked or have expired\n", u.Login)
+	u.RevokedAt = time.Now()
+	if err := users.Put(u.Login, u); err != nil {
+		log.Printf("Error: %s occurred while flagging the github credentials of %s\n", err, u.Login)
+	}
+}
+
+// rotateUserTokens encrypts the tokens of users that were stored in plaintext or with a key other than the
+// vault's current key. Tokens sealed with a key that's no longer configured are flagged as revoked
+func rotateUserTokens() {
+	userMu.Lock()
+	defer userMu.Unlock()
+
+	logins, err := users.Keys()
+	if err != nil {
+		log.Println("Error occurred while listing users: ", err)
+		return
+	}
+
+	for _, login := range logins {
+		u, err := findUser(login)
+		if err != nil {
+			log.Printf("Error: %s occurred while reading user %s\n", err, login)
+			continue
+		}
+
+		var tkn *oauth2.Token
+		switch {
+		case u.AccessToken != "":
+			tkn = &oauth2.Token{AccessToken: u.AccessToken}
+			u.AccessToken = ""
+		case u.Revoked() || !credentials.stale(u.Token):
+			continue
+		default:
+			if tkn, err = u.token(); err != nil {
+				log.Printf("Error: %s occurred while decrypting the github token of %s\n", err, login)
+				flagRevoked(u)
+				continue
+			}
+		}
+
+		if err := u.seal(tkn); err != nil {
+			log.Printf("Error: %s occurred while encrypting the github token of %s\n", err, login)
+			continue
+		}
+		if err := users.Put(login, u); err != nil {
+			log.Printf("Error: %s occurred while saving the github token of %s\n", err, login)
+		}
+	}
+}
+
+func findUser(login string) (*user, error) {
+	u := &user{}
+	found, err := users.Get(login, u)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("unknown user: " + login)
+	}
+	return u, nil
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// mintAPIToken creates a new API token for the user with the given scopes
+// It returns the plain token which must be handed to the user as it can't be recovered
+func mintAPIToken(login, name string, scopes []string) (string, *apiToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+
+	plain := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	tkn := &apiToken{
+		ID:        hashAPIToken(plain),
+		Name:      name,
+		Login:     login,
+		Scopes:    scopes,
+		Hint:      plain[:len(apiTokenPrefix)+4],
+		CreatedAt: time.Now(),
+	}
+
+	if err := apiTokens.Put(tkn.ID, tkn); err != nil {
+		return "", nil, err
+	}
+	return plain, tkn, nil
+}
+
+// userAPITokens lists the API tokens belonging to the user
+func userAPITokens(login string) []apiToken {
+	tokens := []apiToken{}
+	ids, err := apiTokens.Keys()
+	if err != nil {
+		log.Println("Error occurred while listing API tokens: ", err)
+		return tokens
+	}
+
+	for _, id := range ids {
+		tkn := apiToken{}
+		if _, err := apiTokens.Get(id, &tkn); err != nil {
+			log.Printf("Error: %s occurred while reading API token %s\n", err, id)
+			continue
+		}
+		if tkn.Login == login {
+			tokens = append(tokens, tkn)
+		}
+	}
+	return tokens
+}
+
+// revokeAPIToken deletes the token with the given id if it belongs to the user
+func revokeAPIToken(login, id string) error {
+	tkn := apiToken{}
+	found, err := apiTokens.Get(id, &tkn)
+	if err != nil {
+		return err
+	}
+	if !found || tkn.Login != login {
+		return errInvalidAPIToken
+	}
+	return apiTokens.Delete(id)
+}
+
+// authenticateAPIToken looks up the given plain token and records its usage
+func authenticateAPIToken(plain string) (*apiToken, error) {
+	if !strings.HasPrefix(plain, apiTokenPrefix) {
+		return nil, errInvalidAPIToken
+	}
+
+	tkn := &apiToken{}
+	found, err := apiTokens.Get(hashAPIToken(plain), tkn)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errInvalidAPIToken
+	}
+
+	// the whole collection is rewritten on every save, so usage is only recorded once a minute
+	if time.Since(tkn.LastUsedAt) > apiTokenUsageResolution {
+		tkn.LastUsedAt = time.Now()
+		if err := apiTokens.Put(tkn.ID, tkn); err != nil {
+			log.Println("Error occurred while recording API token usage: ", err)
+		}
+	}
+	return tkn, nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validAPIScopes filters out any requested scope that can't be granted to an API token
+func validAPIScopes(requested []string) (scopes []string) {
+	for _, s := range requested {
+		if hasScope(apiScopes, s) && !hasScope(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidAPIScopes(t *testing.T) {
+	cases := []struct {
+		requested []string
+		want      []string
+	}{
+		{nil, nil},
+		{[]string{scopeRead, scopeBuild}, []string{scopeRead, scopeBuild}},
+		{[]string{scopeRead, scopeRead}, []string{scopeRead}},
+		// browser only and unknown scopes can't be granted
+		{[]string{scopeManageTokens, "admin", scopeSubscribe}, []string{scopeSubscribe}},
+	}
+
+	for _, c := range cases {
+		if got := validAPIScopes(c.requested); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("validAPIScopes(%v) = %v; want %v", c.requested, got, c.want)
+		}
+	}
+}
+
+func TestAPITokenLifecycle(t *testing.T) {
+	plain, tkn, err := mintAPIToken("octocat", "ci", []string{scopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(plain, apiTokenPrefix) || !strings.HasPrefix(plain, tkn.Hint) {
+		t.Errorf("minted token %s doesn't start with the prefix and hint %s", plain, tkn.Hint)
+	}
+
+	got, err := authenticateAPIToken(plain)
+	if err != nil || got.Login != "octocat" {
+		t.Fatalf("authenticateAPIToken() = %v, %v; want the token of octocat", got, err)
+	}
+	for _, invalid := range []string{"", "sicuro_nope", plain + "x"} {
+		if _, err := authenticateAPIToken(invalid); err != errInvalidAPIToken {
+			t.Errorf("authenticateAPIToken(%q) returned %v; want errInvalidAPIToken", invalid, err)
+		}
+	}
+
+	if tokens := userAPITokens("octocat"); len(tokens) != 1 || tokens[0].ID != tkn.ID {
+		t.Errorf("userAPITokens(octocat) = %v; want the minted token", tokens)
+	}
+	if err := revokeAPIToken("someone-else", tkn.ID); err != errInvalidAPIToken {
+		t.Errorf("revoking another user's token returned %v; want errInvalidAPIToken", err)
+	}
+	if err := revokeAPIToken("octocat", tkn.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateAPIToken(plain); err != errInvalidAPIToken {
+		t.Errorf("authenticating a revoked token returned %v; want errInvalidAPIToken", err)
+	}
+}
+
+func TestAuthenticateAPITokenRecordsUsage(t *testing.T) {
+	plain, tkn, err := mintAPIToken("octocat", "usage", []string{scopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := authenticateAPIToken(plain)
+	if first.LastUsedAt.IsZero() {
+		t.Fatal("the first use of the token wasn't recorded")
+	}
+
+	// uses within apiTokenUsageResolution aren't saved
+	second, _ := authenticateAPIToken(plain)
+	if !second.LastUsedAt.Equal(first.LastUsedAt) {
+		t.Errorf("LastUsedAt moved from %s to %s within a minute", first.LastUsedAt, second.LastUsedAt)
+	}
+
+	stale := *second
+	stale.LastUsedAt = time.Now().Add(-2 * apiTokenUsageResolution)
+	apiTokens.Put(tkn.ID, stale)
+	third, _ := authenticateAPIToken(plain)
+	if !third.LastUsedAt.After(stale.LastUsedAt) {
+		t.Errorf("LastUsedAt wasn't updated after %s", apiTokenUsageResolution)
+	}
+}
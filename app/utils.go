@@ -1,29 +1,114 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/0sc/sicuro/app/vcs"
+	"github.com/0sc/sicuro/app/webhook"
 	"github.com/0sc/sicuro/ci"
 	"github.com/google/go-github/github"
 	"github.com/gorilla/sessions"
 )
 
-type projectLogListing struct {
-	Name   string
-	Active bool
+// buildsPerPage is the number of builds listed on a page of a project's build history
+const buildsPerPage = 20
+
+// buildStatuses are the statuses the build history can be filtered by
+var buildStatuses = []string{
+	ci.StatusQueued,
+	ci.StatusPending,
+	ci.StatusSuccess,
+	ci.StatusFailure,
+	ci.StatusError,
+	ci.StatusSkipped,
+	ci.StatusCancelled,
 }
 
 type repoWithSubscriptionInfo struct {
 	IsSubscribed bool
+	// Health is the state of the repo's webhook
+	Health *vcs.SubscriptionHealth
+	// Subscriber is the login of the user whose credentials are used for the repo's webhook builds
+	Subscriber string
+	// SubscriberRevoked is true if sicuro can no longer act on github with the subscriber's credentials
+	SubscriberRevoked bool
 	*github.Repository
 }
 
+// repoStates are the subscription states the dashboard's repos can be filtered by
+var repoStates = []string{"subscribed", "unsubscribed", "attention"}
+
+// repoFilter narrows down the repos listed on the dashboard
+// Empty fields match every repo
+type repoFilter struct {
+	// Query matches the repos whose full name contains it, ignoring case
+	Query string
+	Owner string
+	// State is one of repoStates; attention matches subscribed repos whose webhook isn't healthy
+	State string
+}
+
+func (f repoFilter) matches(repo repoWithSubscriptionInfo) bool {
+	if f.Query != "" && !strings.Contains(strings.ToLower(repo.GetFullName()), strings.ToLower(f.Query)) {
+		return false
+	}
+	if f.Owner != "" && repo.Owner.GetLogin() != f.Owner {
+		return false
+	}
+
+	switch f.State {
+	case "subscribed":
+		return repo.IsSubscribed
+	case "unsubscribed":
+		return !repo.IsSubscribed
+	case "attention":
+		return repo.IsSubscribed && !repo.Health.Healthy()
+	}
+	return true
+}
+
+// repoGroup is the repos of an owner listed on the dashboard
+type repoGroup struct {
+	Owner string
+	Repos []repoWithSubscriptionInfo
+}
+
+// groupRepos groups the repos by owner
+// The user's own repos come first followed by those of other owners in alphabetical order
+func groupRepos(repos []repoWithSubscriptionInfo, login string) []repoGroup {
+	groups := []repoGroup{}
+	index := map[string]int{}
+	for _, repo := range repos {
+		owner := repo.Owner.GetLogin()
+		i, ok := index[owner]
+		if !ok {
+			i = len(groups)
+			index[owner] = i
+			groups = append(groups, repoGroup{Owner: owner})
+		}
+		groups[i].Repos = append(groups[i].Repos, repo)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if (groups[i].Owner == login) != (groups[j].Owner == login) {
+			return groups[i].Owner == login
+		}
+		return groups[i].Owner < groups[j].Owner
+	})
+	return groups
+}
+
 func renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
 	err := templates.ExecuteTemplate(w, tmpl+".tmpl", data)
 	if err != nil {
@@ -32,11 +117,49 @@ func renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
 	}
 }
 
+func renderJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("Error occurred while encoding JSON response: ", err)
+	}
+}
+
+func renderJSONError(w http.ResponseWriter, status int, msg string) {
+	renderJSON(w, status, map[string]string{"error": msg})
+}
+
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPath)
+}
+
+// rejectRequest ends a request that can't proceed
+// API clients get a JSON error with the given status
+// while browsers are redirected to the dashboard with msg flashed, if present
+func rejectRequest(w http.ResponseWriter, r *http.Request, status int, msg string, redirStatus int) {
+	if isAPIRequest(r) {
+		if msg == "" {
+			msg = http.StatusText(status)
+		}
+		renderJSONError(w, status, msg)
+		return
+	}
+
+	if msg != "" {
+		addFlashMsg(msg, w, r)
+	}
+	http.Redirect(w, r, dashboardPath, redirStatus)
+}
+
 func logFilePathFromRequest(prefix string, r *http.Request) string {
 	path, _ := filepath.Rel(prefix, r.URL.Path)
 	return fmt.Sprintf("%s%s", filepath.Join(ci.LogDIR, path), ci.LogFileExt)
 }
 
+func loadTemplates() {
+	templates = template.Must(template.ParseFiles(fetchTemplates()...))
+}
+
 func fetchTemplates() (templates []string) {
 	templateFolderName := "templates"
 	templateFolder := filepath.Join(appDIR, templateFolderName)
@@ -58,56 +181,39 @@ func fetchTemplates() (templates []string) {
 	return templates
 }
 
-func listProjectLogsInDir(dirName string) []projectLogListing {
-	fileInfo, err := os.Stat(dirName)
-	logs := []projectLogListing{}
-	if err != nil {
-		log.Printf("An error: %s; occurred with listing logs for %s\n", err, dirName)
-		return logs
-	}
-
-	if !fileInfo.IsDir() {
-		return append(logs, projectLogListing{Name: dirName, Active: ci.ActiveCISession(dirName)})
-	}
-
-	dir, err := os.Open(dirName)
-	if err != nil {
-		log.Printf("An error: %s; occurred will opening dir %s", err, dirName)
-		return logs
-	}
-
-	files, err := dir.Readdir(0)
-	if err != nil {
-		log.Printf("An error: %s; occurred will reading files from dir %s", err, dirName)
-		return logs
+// paginate returns the bounds of the given page of n items
+// Pages past the last one are empty
+func paginate(n, page, perPage int) (start, end int) {
+	start = (page - 1) * perPage
+	if start > n {
+		start = n
 	}
-
-	for _, file := range files {
-		fileFullName := filepath.Join(dirName, file.Name())
-		if file.IsDir() {
-			logs = append(logs, listProjectLogsInDir(fileFullName+"/")...)
-		} else {
-			name, _ := filepath.Rel(ci.LogDIR, fileFullName)
-			name = strings.Replace(name, ci.LogFileExt, "", 1)
-			logs = append(logs, projectLogListing{Name: name, Active: ci.ActiveCISession(fileFullName)})
-		}
+	end = start + perPage
+	if end > n {
+		end = n
 	}
-	return logs
+	return start, end
 }
 
-func getUserProjectsWithSubscriptionInfo(token, webhookPath string) []repoWithSubscriptionInfo {
-	client := newGithubClient(token)
-	repos := []repoWithSubscriptionInfo{}
-	params := vcs.GithubRequestParams{CallbackURL: webhookPath}
-
-	for _, repo := range client.UserRepos() {
-		params.Owner = *(repo.Owner.Login)
-		params.Repo = *(repo.Name)
+// pageURL returns the request's URL pointing at the given page
+func pageURL(r *http.Request, page int) string {
+	params := r.URL.Query()
+	params.Set("page", strconv.Itoa(page))
+	return fmt.Sprintf("%s?%s", r.URL.Path, params.Encode())
+}
 
-		repos = append(repos, repoWithSubscriptionInfo{client.IsRepoSubscribed(params), repo})
+// projectBranches returns the branches the project has been built for
+func projectBranches(project string) []string {
+	branches := []string{}
+	seen := map[string]bool{}
+	for _, b := range ci.ProjectBuilds(project, ci.BuildFilter{}) {
+		if b.Branch != "" && !seen[b.Branch] {
+			seen[b.Branch] = true
+			branches = append(branches, b.Branch)
+		}
 	}
-
-	return repos
+	sort.Strings(branches)
+	return branches
 }
 
 func getProject(token, owner, project string) (*github.Repository, error) {
@@ -124,6 +230,23 @@ func fetchSession(r *http.Request) (*sessions.Session, error) {
 	return sessionStore.Get(r, sessionName)
 }
 
+// csrfToken returns the session's CSRF token, adding one to the session if it has none
+// Pages with forms render it in the csrf_token field; the caller saves the session
+func csrfToken(session *sessions.Session) string {
+	if tkn, ok := session.Values[csrfTokenKey].(string); ok && tkn != "" {
+		return tkn
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Println("Error occurred while generating a CSRF token: ", err)
+		return ""
+	}
+	tkn := base64.RawURLEncoding.EncodeToString(b)
+	session.Values[csrfTokenKey] = tkn
+	return tkn
+}
+
 func addFlashMsg(msg string, w http.ResponseWriter, r *http.Request) {
 	session, _ := fetchSession(r)
 	session.AddFlash(msg)
@@ -133,3 +256,22 @@ func addFlashMsg(msg string, w http.ResponseWriter, r *http.Request) {
 func newGithubClient(token string) *vcs.GithubClient {
 	return vcs.NewGithubClient(token)
 }
+
+// setupWebhook gives the webhook package access to the projects on github
+func setupWebhook() {
+	webhook.FetchConfig = fetchProjectConfig
+	webhook.FetchCommitMessage = fetchCommitMessage
+	webhook.Reporters = setWebhookReporters
+	webhook.LinkedPullRequest = summarizeLinkedBuild
+}
+
+func fetchCommitMessage(owner, repo, sha string) (string, error) {
+	params := vcs.GithubRequestParams{Owner: owner, Repo: repo, Ref: sha}
+	return repoClient(owner, repo).CommitMessage(params)
+}
+
+// fetchProjectConfig fetches the project's sicuro.json
+func fetchProjectConfig(owner, repo, ref string) ([]byte, error) {
+	params := vcs.GithubRequestParams{Owner: owner, Repo: repo, Ref: ref}
+	return repoClient(owner, repo).FileContent(params, ci.ConfigFileName)
+}
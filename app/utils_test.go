@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	cases := []struct {
+		n, page, perPage int
+		start, end       int
+	}{
+		{0, 1, 10, 0, 0},
+		{5, 1, 10, 0, 5},
+		{25, 1, 10, 0, 10},
+		{25, 2, 10, 10, 20},
+		{25, 3, 10, 20, 25},
+		{20, 2, 10, 10, 20},
+		// pages past the last one are empty
+		{20, 3, 10, 20, 20},
+		{25, 9, 10, 25, 25},
+	}
+
+	for _, c := range cases {
+		start, end := paginate(c.n, c.page, c.perPage)
+		if start != c.start || end != c.end {
+			t.Errorf("paginate(%d, %d, %d) = %d, %d; want %d, %d", c.n, c.page, c.perPage, start, end, c.start, c.end)
+		}
+	}
+}
+
+func TestPageURL(t *testing.T) {
+	r := httptest.NewRequest("GET", "/builds?owner=octocat&project=hello&status=failure&page=2", nil)
+
+	want := "/builds?owner=octocat&page=3&project=hello&status=failure"
+	if got := pageURL(r, 3); got != want {
+		t.Errorf("pageURL(%s, 3) = %s; want %s", r.URL, got, want)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// vaultKeysEnv lists the keys credentials are encrypted with as comma separated id:key pairs
+// where key is 32 base64 encoded random bytes e.g 2024-06:c2VjcmV0... The first key encrypts;
+// the others are only kept to decrypt credentials until they've been rotated to the first key
+const vaultKeysEnv = "SICURO_VAULT_KEYS"
+
+var (
+	// credentials is the vault github tokens are encrypted with before they're stored
+	credentials *vault
+
+	errUnknownVaultKey = errors.New("credential was encrypted with a key that's no longer configured")
+)
+
+// vault encrypts credentials with AES-GCM
+// Sealed credentials are of the form keyID:base64(nonce+ciphertext) so they can be decrypted after the key is rotated
+type vault struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+func newVault(spec string) (*vault, error) {
+	v := &vault{keys: map[string]cipher.AEAD{}}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid vault key %q; expected id:key", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("vault key %s must be 32 base64 encoded bytes", parts[0])
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		v.keys[parts[0]] = gcm
+		if v.current == "" {
+			v.current = parts[0]
+		}
+	}
+
+	if v.current == "" {
+		return nil, errors.New("no vault keys given")
+	}
+	return v, nil
+}
+
+// seal encrypts the credential with the current key
+func (v *vault) seal(plain string) (string, error) {
+	gcm := v.keys[v.current]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), []byte(v.current))
+	return v.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a credential sealed with any of the vault's keys
+func (v *vault) open(sealed string) (string, error) {
+	parts := strings.SplitN(sealed, ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed credential")
+	}
+	gcm, ok := v.keys[parts[0]]
+	if !ok {
+		return "", errUnknownVaultKey
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", errors.New("malformed credential")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(parts[0]))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// stale returns true if the credential wasn't sealed with the current key
+func (v *vault) stale(sealed string) bool {
+	return !strings.HasPrefix(sealed, v.current+":")
+}
+
+// setupVault loads the vault keys from SICURO_VAULT_KEYS and re-encrypts stored credentials with the current key
+// It refuses to start without keys; a key that changed on every restart would revoke every user's stored token
+func setupVault() {
+	spec := os.Getenv(vaultKeysEnv)
+	if spec == "" {
+		log.Fatalf("%s must be set; see the README for generating a key\n", vaultKeysEnv)
+	}
+
+	var err error
+	if credentials, err = newVault(spec); err != nil {
+		log.Fatalf("Error loading %s: %s\n", vaultKeysEnv, err)
+	}
+	rotateUserTokens()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// vaultKey returns a vault key spec with a random key under the given id
+func vaultKey(t *testing.T, id string) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+// useVault sets the credentials vault to one with the given keys for the rest of the test
+func useVault(t *testing.T, spec string) func() {
+	orig := credentials
+	v, err := newVault(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials = v
+	return func() { credentials = orig }
+}
+
+func TestNewVaultRejectsInvalidKeys(t *testing.T) {
+	short := base64.StdEncoding.EncodeToString([]byte("too short"))
+	for _, spec := range []string{"", " , ", "nokey", ":" + short, "k1:" + short, "k1:not base64!"} {
+		if _, err := newVault(spec); err == nil {
+			t.Errorf("newVault(%q) succeeded; want an error", spec)
+		}
+	}
+}
+
+func TestVaultSealOpen(t *testing.T) {
+	v, err := newVault(vaultKey(t, "k2") + "," + vaultKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := v.seal("gho_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "k2:") || strings.Contains(sealed, "gho_secret") || v.stale(sealed) {
+		t.Errorf("seal() = %s; want it encrypted with the current key k2", sealed)
+	}
+	if again, _ := v.seal("gho_secret"); again == sealed {
+		t.Error("sealing the same credential twice gave the same ciphertext; want a fresh nonce each time")
+	}
+	if plain, err := v.open(sealed); err != nil || plain != "gho_secret" {
+		t.Errorf("open(seal(gho_secret)) = %q, %v; want gho_secret", plain, err)
+	}
+
+	// the key id is authenticated so a credential can't be passed off as sealed by another key
+	relabelled := "k1:" + strings.TrimPrefix(sealed, "k2:")
+	if _, err := v.open(relabelled); err == nil {
+		t.Error("opening a credential under another key's id succeeded; want an error")
+	}
+	if _, err := v.open("k3:" + strings.TrimPrefix(sealed, "k2:")); err != errUnknownVaultKey {
+		t.Errorf("opening a credential of an unknown key returned %v; want errUnknownVaultKey", err)
+	}
+	for _, malformed := range []string{"", "k2", "k2:not base64!", "k2:AAAA"} {
+		if _, err := v.open(malformed); err == nil {
+			t.Errorf("open(%q) succeeded; want an error", malformed)
+		}
+	}
+}
+
+func TestRotateUserTokens(t *testing.T) {
+	oldKey, newKey := vaultKey(t, "old"), vaultKey(t, "new")
+	defer useVault(t, oldKey)()
+
+	if err := saveUser("rotated", &oauth2.Token{AccessToken: "gho_rotated", RefreshToken: "ghr_rotated"}); err != nil {
+		t.Fatal(err)
+	}
+	// a record saved before tokens were encrypted
+	if err := users.Put("legacy", user{Login: "legacy", AccessToken: "gho_legacy"}); err != nil {
+		t.Fatal(err)
+	}
+
+	useVault(t, newKey+","+oldKey)
+	rotateUserTokens()
+
+	for login, want := range map[string]string{"rotated": "gho_rotated", "legacy": "gho_legacy"} {
+		u, err := findUser(login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.AccessToken != "" || credentials.stale(u.Token) {
+			t.Errorf("%s's token wasn't re-encrypted with the new key: %+v", login, u)
+		}
+		if got, err := userToken(login); err != nil || got != want {
+			t.Errorf("userToken(%s) = %q, %v; want %s", login, got, err, want)
+		}
+	}
+	if u, _ := findUser("rotated"); credentials.stale(u.RefreshToken) {
+		t.Errorf("the refresh token wasn't re-encrypted with the new key: %s", u.RefreshToken)
+	}
+
+	// tokens sealed with a key that was dropped can't be read anymore
+	useVault(t, vaultKey(t, "newer"))
+	rotateUserTokens()
+	if _, err := userToken("rotated"); err != errCredentialsRevoked {
+		t.Errorf("userToken() of a token sealed with a dropped key returned %v; want errCredentialsRevoked", err)
+	}
+}
@@ -0,0 +1,139 @@
+package vcs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// integrationPreviewHeader is the media type of the github apps API preview
+	integrationPreviewHeader = "application/vnd.github.machine-man-preview+json"
+	// appTokenLifetime is how long the JWTs authenticating as the app are valid for; github allows up to 10 minutes
+	appTokenLifetime = 9 * time.Minute
+	// installationTokenMargin is how long before it expires an installation token is replaced
+	installationTokenMargin = time.Minute
+)
+
+// GithubApp authenticates as sicuro's github app
+// Acting on a repo as the app's installation is required for APIs that aren't open to OAuth apps e.g check runs
+type GithubApp struct {
+	id  string
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	tokens map[string]*installationToken
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewGithubApp returns the github app with the given ID authenticating with its PEM encoded private key
+func NewGithubApp(id string, pemKey []byte) (*GithubApp, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &GithubApp{id: id, key: key, tokens: map[string]*installationToken{}}, nil
+}
+
+// jwt returns a token authenticating as the app itself
+func (app *GithubApp) jwt() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		// allow for clock drift with github
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(appTokenLifetime).Unix(),
+		"iss": app.id,
+	})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, app.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// appClient returns a github client authenticated as the app itself
+func (app *GithubApp) appClient() (*github.Client, error) {
+	jwt, err := app.jwt()
+	if err != nil {
+		return nil, err
+	}
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: jwt, TokenType: "Bearer"})
+	return github.NewClient(oauth2.NewClient(ctx, ts)), nil
+}
+
+// InstallationClient returns a client acting as the app's installation on the given repo
+// It returns an error if the app isn't installed on the repo
+func (app *GithubApp) InstallationClient(owner, repo string) (*GithubClient, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	key := owner + "/" + repo
+	tkn, ok := app.tokens[key]
+	if !ok || time.Now().Add(installationTokenMargin).After(tkn.ExpiresAt) {
+		var err error
+		if tkn, err = app.installationToken(owner, repo); err != nil {
+			return nil, err
+		}
+		app.tokens[key] = tkn
+	}
+	return NewGithubClient(tkn.Token), nil
+}
+
+func (app *GithubApp) installationToken(owner, repo string) (*installationToken, error) {
+	client, err := app.appClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%s/%s/installation", owner, repo), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", integrationPreviewHeader)
+
+	installation := struct {
+		ID int64 `json:"id"`
+	}{}
+	if _, err := client.Do(ctx, req, &installation); err != nil {
+		return nil, fmt.Errorf("app isn't installed on %s/%s: %s", owner, repo, err)
+	}
+
+	req, err = client.NewRequest("POST", fmt.Sprintf("app/installations/%d/access_tokens", installation.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", integrationPreviewHeader)
+
+	tkn := &installationToken{}
+	if _, err := client.Do(ctx, req, tkn); err != nil {
+		return nil, err
+	}
+	return tkn, nil
+}
@@ -0,0 +1,167 @@
+package vcs
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// checksPreviewHeader is the media type of the checks API preview
+	// The vendored go-github predates the checks API, so check runs are requested directly
+	checksPreviewHeader = "application/vnd.github.antiope-preview+json"
+	// maxAnnotationsPerRequest is the most annotations github accepts in a single check run request
+	// Further annotations are added with more updates
+	maxAnnotationsPerRequest = 50
+	checkRunName             = "SicuroCI"
+)
+
+// CheckRun is a github check run; a build's status along with its output on a commit
+type CheckRun struct {
+	ID          int64           `json:"id,omitempty"`
+	Name        string          `json:"name,omitempty"`
+	HeadSHA     string          `json:"head_sha,omitempty"`
+	DetailsURL  string          `json:"details_url,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Conclusion  string          `json:"conclusion,omitempty"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	Output      *CheckRunOutput `json:"output,omitempty"`
+}
+
+// CheckRunOutput is the summary and annotations shown on a check run
+type CheckRunOutput struct {
+	Title       string               `json:"title"`
+	Summary     string               `json:"summary"`
+	Text        string               `json:"text,omitempty"`
+	Annotations []CheckRunAnnotation `json:"annotations,omitempty"`
+}
+
+// CheckRunAnnotation flags a line of a file on a check run
+type CheckRunAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Message         string `json:"message"`
+}
+
+// CreateCheckRun creates the check run on the repo
+// Check runs can only be created by a github app; see GithubApp.InstallationClient
+func (client *GithubClient) CreateCheckRun(params GithubRequestParams, run *CheckRun) (*CheckRun, error) {
+	u := fmt.Sprintf("repos/%s/%s/check-runs", params.Owner, params.Repo)
+	return client.sendCheckRun("POST", u, run)
+}
+
+// UpdateCheckRun updates the check run with the given run's ID
+// Annotations beyond what github accepts in one request are sent in further updates
+func (client *GithubClient) UpdateCheckRun(params GithubRequestParams, run *CheckRun) (*CheckRun, error) {
+	u := fmt.Sprintf("repos/%s/%s/check-runs/%d", params.Owner, params.Repo, run.ID)
+
+	var rest []CheckRunAnnotation
+	if run.Output != nil && len(run.Output.Annotations) > maxAnnotationsPerRequest {
+		out := *run.Output
+		rest = out.Annotations[maxAnnotationsPerRequest:]
+		out.Annotations = out.Annotations[:maxAnnotationsPerRequest]
+		first := *run
+		first.Output = &out
+		run = &first
+	}
+
+	updated, err := client.sendCheckRun("PATCH", u, run)
+	for err == nil && len(rest) > 0 {
+		n := len(rest)
+		if n > maxAnnotationsPerRequest {
+			n = maxAnnotationsPerRequest
+		}
+		out := &CheckRunOutput{Title: run.Output.Title, Summary: run.Output.Summary, Annotations: rest[:n]}
+		rest = rest[n:]
+		_, err = client.sendCheckRun("PATCH", u, &CheckRun{Output: out})
+	}
+	return updated, err
+}
+
+func (client *GithubClient) sendCheckRun(method, u string, run *CheckRun) (*CheckRun, error) {
+	req, err := client.NewRequest(method, u, run)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", checksPreviewHeader)
+
+	result := &CheckRun{}
+	if _, err := client.Do(ctx, req, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UpdateBuildCheck returns a function that when executed reports the build's state as a check run on params.Ref
+// The check run is created on the first update and updated afterwards. output returns the check run's output
+// for the state. If the check run can't be created, e.g because the client isn't a github app installation,
+// the state is reported with fallback instead, as are later states
+func (client *GithubClient) UpdateBuildCheck(params GithubRequestParams, output func(state string) *CheckRunOutput, fallback func(string)) func(string) {
+	var run *CheckRun
+	useFallback := false
+
+	return func(state string) {
+		if useFallback {
+			fallback(state)
+			return
+		}
+
+		update := checkRunState(state)
+		update.DetailsURL = params.CallbackURL
+		update.Output = output(state)
+
+		if run == nil {
+			// annotations are left to the update so they can be sent in batches
+			create := *update
+			create.Name = checkRunName
+			create.HeadSHA = params.Ref
+			if update.Output != nil {
+				out := *update.Output
+				out.Annotations = nil
+				create.Output = &out
+			}
+
+			var err error
+			if run, err = client.CreateCheckRun(params, &create); err != nil {
+				log.Printf("Error %s occurred while creating check run with params %v; reporting statuses instead\n", err, params)
+				useFallback = true
+				fallback(state)
+				return
+			}
+			if update.Output == nil || len(update.Output.Annotations) == 0 {
+				log.Println("Successfully created check run with status:", state)
+				return
+			}
+		}
+
+		update.ID = run.ID
+		if _, err := client.UpdateCheckRun(params, update); err != nil {
+			log.Printf("Error %s occurred while updating check run %d to %s\n", err, run.ID, state)
+			return
+		}
+		log.Println("Successfully updated check run to:", state)
+	}
+}
+
+// checkRunState maps a sicuro build state to a check run's status and conclusion
+func checkRunState(state string) *CheckRun {
+	now := time.Now()
+	run := &CheckRun{Status: "completed", CompletedAt: &now}
+
+	switch state {
+	case "queued":
+		return &CheckRun{Status: "queued"}
+	case "pending":
+		return &CheckRun{Status: "in_progress", StartedAt: &now}
+	case "success", "failure", "cancelled":
+		run.Conclusion = state
+	case "skipped":
+		run.Conclusion = "neutral"
+	default:
+		run.Conclusion = "failure"
+	}
+	return run
+}
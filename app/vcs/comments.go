@@ -0,0 +1,107 @@
+package vcs
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	// summaryMarker identifies sicuro's summary comment on a pull request so it's updated in place
+	summaryMarker = "<!-- sicuro:summary -->"
+	// maxSummaryFailures is the most failures listed in a summary comment
+	maxSummaryFailures = 20
+)
+
+// BuildSummary is what's shown in the summary comment of a build on a pull request
+type BuildSummary struct {
+	Number int
+	Status string
+	// URL links to the build's log
+	URL   string
+	Steps []StepSummary
+	// Failures are the failing tests and lint errors e.g spec/models/user_spec.rb:12 User validates the email
+	Failures []string
+	// Coverage is the percentage of lines the build's tests covered, if they reported it
+	Coverage *float64
+	// BaseCoverage is the coverage of the latest build of BaseBranch, if known
+	BaseCoverage *float64
+	BaseBranch   string
+}
+
+// StepSummary is the status of a step of the build in the summary comment
+type StepSummary struct {
+	Name   string
+	Status string
+}
+
+// markdown renders the summary as the body of a comment
+func (s *BuildSummary) markdown() string {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, summaryMarker)
+	fmt.Fprintf(&b, "### Sicuro build [#%d](%s): %s\n\n", s.Number, s.URL, s.Status)
+
+	if len(s.Steps) > 0 {
+		fmt.Fprintln(&b, "| Step | Status |")
+		fmt.Fprintln(&b, "| --- | --- |")
+		for _, step := range s.Steps {
+			fmt.Fprintf(&b, "| %s | %s |\n", step.Name, step.Status)
+		}
+		fmt.Fprintln(&b)
+	}
+
+	if len(s.Failures) > 0 {
+		fmt.Fprintln(&b, "**Failures**")
+		fmt.Fprintln(&b)
+		for i, failure := range s.Failures {
+			if i == maxSummaryFailures {
+				fmt.Fprintf(&b, "- and %d more\n", len(s.Failures)-i)
+				break
+			}
+			fmt.Fprintf(&b, "- %s\n", strings.Replace(failure, "\n", " ", -1))
+		}
+		fmt.Fprintln(&b)
+	}
+
+	if s.Coverage != nil {
+		fmt.Fprintf(&b, "**Coverage** %.2f%%", *s.Coverage)
+		if s.BaseCoverage != nil {
+			fmt.Fprintf(&b, " (%+.2f%% compared to %s)", *s.Coverage-*s.BaseCoverage, s.BaseBranch)
+		}
+		fmt.Fprint(&b, "\n\n")
+	}
+
+	fmt.Fprintf(&b, "[View the build log](%s)\n", s.URL)
+	return b.String()
+}
+
+// UpdatePullRequestSummary keeps a single comment summarising the latest build on the pull request
+// The comment is created the first time and edited in place afterwards
+func (client *GithubClient) UpdatePullRequestSummary(params GithubRequestParams, number int, summary *BuildSummary) error {
+	comment := &github.IssueComment{Body: github.String(summary.markdown())}
+
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		comments, resp, err := client.Issues.ListComments(ctx, params.Owner, params.Repo, number, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range comments {
+			if strings.Contains(c.GetBody(), summaryMarker) {
+				_, _, err := client.Issues.EditComment(ctx, params.Owner, params.Repo, c.GetID(), comment)
+				return err
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	_, _, err := client.Issues.CreateComment(ctx, params.Owner, params.Repo, number, comment)
+	return err
+}
@@ -2,7 +2,9 @@ package vcs
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net/http"
 
 	"golang.org/x/oauth2"
 
@@ -11,6 +13,9 @@ import (
 
 var ctx = context.Background()
 
+// buildStatusContext is the status context the whole build is reported under
+const buildStatusContext = "SicuroCI"
+
 // GithubClient is a wrapper around the github.client instance.
 // It allows addition of custom method to the instance
 type GithubClient struct {
@@ -34,59 +39,140 @@ type GithubRequestParams struct {
 
 // NewGithubClient creates a new GithubClient with the given token
 // The given token is passed to the underlying github.Client initialization
+// An empty token creates an unauthenticated client which can only access public repos
 func NewGithubClient(token string) *GithubClient {
+	if token == "" {
+		return &GithubClient{github.NewClient(nil)}
+	}
+
 	tkn := &oauth2.Token{AccessToken: token}
 	ts := oauth2.StaticTokenSource(tkn)
 	tc := oauth2.NewClient(ctx, ts)
 	return &GithubClient{github.NewClient(tc)}
 }
 
+// NewGithubUserClient creates a new GithubClient acting as a user with the given token
+// revoked is called whenever github rejects the token e.g because the user revoked sicuro's access
+func NewGithubUserClient(token string, revoked func()) *GithubClient {
+	tc := oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}))
+	tc.Transport = &revocationTransport{base: tc.Transport, revoked: revoked}
+	return &GithubClient{github.NewClient(tc)}
+}
+
+// revocationTransport reports the unauthorized responses of requests made with a user's token
+type revocationTransport struct {
+	base    http.RoundTripper
+	revoked func()
+}
+
+func (t *revocationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.revoked()
+	}
+	return resp, err
+}
+
 // UpdateBuildStatus returns a function that when executed updates the repo status with the given status
 // it takes the repo, owner and ref as args
 func (client *GithubClient) UpdateBuildStatus(params GithubRequestParams) func(string) {
-	status := &github.RepoStatus{
-		TargetURL: github.String(params.CallbackURL),
-		Context:   github.String("SicuroCI"),
-	}
-
-	return func(state string) {
-		var description string
-
+	return client.statusUpdater(params, buildStatusContext, "", func(state string) string {
 		switch state {
 		case "success":
-			description = "Your tests passed on Sicuro"
+			return "Your tests passed on Sicuro"
 		case "pending":
-			description = "Sicuro is running your tests"
+			return "Sicuro is running your tests"
+		case "queued":
+			return "Your tests are queued on Sicuro"
+		case "failure":
+			return "Your tests failed on Sicuro"
+		case "cancelled":
+			return "Sicuro cancelled this build"
+		case "skipped":
+			return "Sicuro skipped this build"
+		}
+		return "Sicuro couldn't run your tests. An error occurred"
+	})
+}
+
+// UpdateStepStatus returns a function that when executed updates the repo status of a step of the build
+// e.g test, under its own context e.g sicuro/test, so it can be required on its own
+func (client *GithubClient) UpdateStepStatus(params GithubRequestParams, step string) func(string) {
+	// the step's status was set pending when the build started so one that didn't run is closed as an error
+	// rather than left pending
+	return client.statusUpdater(params, StepStatusContext(step), "error", func(state string) string {
+		switch state {
+		case "success":
+			return fmt.Sprintf("The %s step passed on Sicuro", step)
+		case "pending", "queued":
+			return fmt.Sprintf("Sicuro is running the %s step", step)
 		case "failure":
-			description = "Your tests failed on Sicuro"
-		case "error":
-			description = "Sicuro couldn't run your tests. An error occurred"
+			return fmt.Sprintf("The %s step failed on Sicuro", step)
+		case "cancelled":
+			return fmt.Sprintf("Sicuro cancelled the %s step", step)
+		case "skipped":
+			return fmt.Sprintf("The %s step didn't run", step)
+		}
+		return fmt.Sprintf("The %s step didn't run. An error occurred", step)
+	})
+}
+
+// StepStatusContext returns the status context a build step is reported under
+func StepStatusContext(step string) string {
+	return "sicuro/" + step
+}
+
+// statusUpdater returns a function that when executed sets the repo status under the given context
+// to the state, described by describe. Skipped states are reported as skipped, or not at all if it's empty
+func (client *GithubClient) statusUpdater(params GithubRequestParams, context, skipped string, describe func(string) string) func(string) {
+	return func(state string) {
+		ghState, ok := githubStatusState(state)
+		if !ok && skipped != "" {
+			ghState, ok = skipped, true
+		}
+		if !ok {
+			log.Printf("Not reporting status %s as %s; github statuses have no state for it\n", context, state)
+			return
 		}
 
-		status.State = github.String(state)
-		status.Description = github.String(description)
+		status := &github.RepoStatus{
+			TargetURL:   github.String(params.CallbackURL),
+			Context:     github.String(context),
+			State:       github.String(ghState),
+			Description: github.String(describe(state)),
+		}
 		_, _, err := client.Repositories.CreateStatus(ctx, params.Owner, params.Repo, params.Ref, status)
 
 		if err != nil {
-			log.Println("Error occurred while updating repo status on the project: ", err)
+			log.Printf("Error occurred while updating repo status %s on the project: %s\n", context, err)
 			return
 		}
-		log.Println("Successfully update project status to:", state)
+		log.Printf("Successfully update project status %s to: %s\n", context, state)
 	}
 }
 
+// githubStatusState maps a sicuro build state to the github status states: pending, success, failure and error
+// It returns false for skipped builds and steps; github statuses have no neutral state and reporting them as
+// passing would satisfy required status checks without any tests having run. Check runs report them as neutral
+func githubStatusState(state string) (string, bool) {
+	switch state {
+	case "pending", "success", "failure":
+		return state, true
+	case "queued":
+		return "pending", true
+	case "skipped":
+		return "", false
+	}
+	return "error", true
+}
+
 // Subscribe adds the sicuro webhook to the given repo
-// TODO: save the access token of the user subscribing a repo to the database to use for offline actions such as build status update
 func (client *GithubClient) Subscribe(params GithubRequestParams) error {
 	hook := github.Hook{
 		Name:   github.String("web"),
 		Active: github.Bool(true),
-		Events: []string{"push", "pull_request"},
-		Config: map[string]interface{}{
-			"content_type": "json",
-			"url":          params.CallbackURL,
-			"secret":       params.Creds,
-		},
+		Events: webhookEvents,
+		Config: webhookConfig(params),
 	}
 
 	_, _, err := client.Repositories.CreateHook(ctx, params.Owner, params.Repo, &hook)
@@ -98,19 +184,137 @@ func (client *GithubClient) Subscribe(params GithubRequestParams) error {
 	return err
 }
 
-// UserRepos returns a list of the github repos belongs to the user
-// The user here refers to the owner of the access token used for the  github client
-// Although the github api allows to explicitly specify a user,
-// For now let it default to the user owning the access token
+// Unsubscribe deletes the sicuro webhooks i.e those posting to params.CallbackURL from the given repo
+// It returns the number of webhooks deleted; none is not an error as the repo isn't subscribed either way
+func (client *GithubClient) Unsubscribe(params GithubRequestParams) (int, error) {
+	hooks, _, err := client.Repositories.ListHooks(ctx, params.Owner, params.Repo, &github.ListOptions{})
+	if err != nil {
+		log.Printf("Error %s occurred while listing webhooks with params %v", err, params)
+		return 0, err
+	}
+
+	deleted := 0
+	for _, hook := range hooks {
+		if hook.Config["url"] != params.CallbackURL {
+			continue
+		}
+		if _, err := client.Repositories.DeleteHook(ctx, params.Owner, params.Repo, hook.GetID()); err != nil {
+			log.Printf("Error %s occurred while deleting webhook %d with params %v", err, hook.GetID(), params)
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// RepoPage is a page of the user's repos along with the ETag github returned for it
+type RepoPage struct {
+	ETag  string
+	Repos []*github.Repository
+}
+
+// UserRepos returns the github repos the user can administer i.e those the user can subscribe to sicuro
+// These are the user's own repos along with the repos of other users and organizations the user has admin access to
+// The user here refers to the owner of the access token used for the github client
 func (client *GithubClient) UserRepos() []*github.Repository {
-	repos, _, err := client.Repositories.List(ctx, "", nil)
+	pages, err := client.UserRepoPages(nil)
 	if err != nil {
 		log.Println("Error fetching users repo: ", err)
 	}
+	return AdminRepos(pages)
+}
+
+// UserRepoPages lists all the user's repos a page at a time
+// Each page is requested conditionally on the ETag of the cached page at the same position, so unchanged pages
+// are taken from the cache; github doesn't count those requests against the rate limit
+func (client *GithubClient) UserRepoPages(cached []RepoPage) ([]RepoPage, error) {
+	pages := []RepoPage{}
+	for n := 1; ; n++ {
+		u := fmt.Sprintf("user/repos?affiliation=owner,collaborator,organization_member&sort=full_name&per_page=100&page=%d", n)
+		req, err := client.NewRequest("GET", u, nil)
+		if err != nil {
+			return pages, err
+		}
+		if len(cached) >= n && cached[n-1].ETag != "" {
+			req.Header.Set("If-None-Match", cached[n-1].ETag)
+		}
+
+		page := RepoPage{}
+		resp, err := client.Do(ctx, req, &page.Repos)
+		if resp != nil && resp.StatusCode == http.StatusNotModified {
+			pages = append(pages, cached[n-1])
+			// github doesn't always send the Link header with a 304; the cache knows whether there are more pages
+			if len(cached) == n {
+				return pages, nil
+			}
+			continue
+		}
+		if err != nil {
+			return pages, err
+		}
+
+		page.ETag = resp.Header.Get("ETag")
+		pages = append(pages, page)
+		if resp.NextPage == 0 {
+			return pages, nil
+		}
+	}
+}
 
+// AdminRepos returns the repos of the pages the user has admin access to
+func AdminRepos(pages []RepoPage) []*github.Repository {
+	repos := []*github.Repository{}
+	for _, page := range pages {
+		for _, repo := range page.Repos {
+			if repo.Permissions != nil && (*repo.Permissions)["admin"] {
+				repos = append(repos, repo)
+			}
+		}
+	}
 	return repos
 }
 
+// Username returns the login of the user owning the access token used for the github client
+func (client *GithubClient) Username() (string, error) {
+	user, _, err := client.Users.Get(ctx, "")
+	if err != nil {
+		log.Println("Error fetching user: ", err)
+		return "", err
+	}
+
+	return user.GetLogin(), nil
+}
+
+// FileContent returns the content of the file at the given path in the repo at params.Ref
+// It returns nil content and no error if the file doesn't exist
+func (client *GithubClient) FileContent(params GithubRequestParams, path string) ([]byte, error) {
+	opts := &github.RepositoryContentGetOptions{Ref: params.Ref}
+	file, _, resp, err := client.Repositories.GetContents(ctx, params.Owner, params.Repo, path, opts)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Error %s occurred fetching %s with params %v", err, path, params)
+		return nil, err
+	}
+	if file == nil {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	content, err := file.GetContent()
+	return []byte(content), err
+}
+
+// CommitMessage returns the message of the commit params.Ref in the repo
+func (client *GithubClient) CommitMessage(params GithubRequestParams) (string, error) {
+	commit, _, err := client.Repositories.GetCommit(ctx, params.Owner, params.Repo, params.Ref)
+	if err != nil {
+		log.Printf("Error %s occurred fetching commit with params %v", err, params)
+		return "", err
+	}
+	return commit.GetCommit().GetMessage(), nil
+}
+
 // Repo fetches and returns the github repo with the given params
 func (client *GithubClient) Repo(params GithubRequestParams) (repo *github.Repository, err error) {
 	repo, _, err = client.Repositories.Get(ctx, params.Owner, params.Repo)
@@ -148,6 +352,6 @@ func hasActiveWebhook(hook *github.Hook, webhookPath string) bool {
 		return false
 	}
 
-	// TODO: also check that the webhook is subscribed to the right events => ["pull_request" "push"]
+	// the webhook's events and deliveries are inspected by CheckSubscription
 	return true
 }
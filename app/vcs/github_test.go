@@ -0,0 +1,64 @@
+package vcs
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestUserRepoPagesETags(t *testing.T) {
+	// pages maps the page number to its ETag and repo; github sends a Link header to every page but the last
+	pages := map[string][2]string{"1": {`"p1"`, "octocat/hello"}, "2": {`"p2"`, "octocat/world"}}
+	requests := 0
+	client, done := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		n := r.URL.Query().Get("page")
+		page, ok := pages[n]
+		if r.URL.Path != "/user/repos" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == page[0] {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if n == "1" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s?page=2>; rel="next"`, r.URL.Path))
+		}
+		w.Header().Set("ETag", page[0])
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[{"full_name": %q, "permissions": {"admin": true}}]`, page[1])
+	}))
+	defer done()
+
+	cached, err := client.UserRepoPages(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 2 || cached[0].ETag != `"p1"` || cached[1].ETag != `"p2"` || requests != 2 {
+		t.Fatalf("UserRepoPages(nil) = %+v after %d requests; want pages p1 and p2", cached, requests)
+	}
+
+	// unchanged pages come from the cache, including the last one whose 304 has no Link header
+	requests = 0
+	got, err := client.UserRepoPages(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Repos[0] != cached[0].Repos[0] || got[1].Repos[0] != cached[1].Repos[0] || requests != 2 {
+		t.Errorf("UserRepoPages(cached) = %+v after %d requests; want the cached pages", got, requests)
+	}
+
+	// a changed page is fetched again
+	pages["2"] = [2]string{`"p2b"`, "octocat/spoon-knife"}
+	got, err = client.UserRepoPages(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Repos[0] != cached[0].Repos[0] || got[1].ETag != `"p2b"` || got[1].Repos[0].GetFullName() != "octocat/spoon-knife" {
+		t.Errorf("UserRepoPages(cached) = %+v; want the cached first page and the changed second page", got)
+	}
+	if repos := AdminRepos(got); len(repos) != 2 {
+		t.Errorf("AdminRepos() = %v; want both repos", repos)
+	}
+}
@@ -0,0 +1,184 @@
+package vcs
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// webhookEvents are the events the sicuro webhook must be subscribed to
+var webhookEvents = []string{"push", "pull_request", "create", "delete"}
+
+// hookStatus is a repo webhook as listed by github
+// The vendored go-github predates the last_response field, so hooks are listed directly
+type hookStatus struct {
+	ID           int64                  `json:"id"`
+	Active       bool                   `json:"active"`
+	Events       []string               `json:"events"`
+	Config       map[string]interface{} `json:"config"`
+	LastResponse HookResponse           `json:"last_response"`
+}
+
+// HookResponse is the outcome of the latest delivery of a webhook
+type HookResponse struct {
+	// Code is the HTTP status of the response; it's nil if nothing has been delivered yet
+	Code    *int   `json:"code"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// SubscriptionHealth describes the state of the sicuro webhook on a repo
+type SubscriptionHealth struct {
+	// Subscribed is true if the repo has a webhook posting to sicuro, healthy or not
+	Subscribed   bool
+	HookID       int64
+	LastResponse HookResponse
+	// Problems describes what's wrong with the webhook e.g missing events; it's empty for a healthy webhook
+	Problems []string
+}
+
+// Healthy returns true if the repo has a webhook delivering the events sicuro needs
+func (h *SubscriptionHealth) Healthy() bool {
+	return h.Subscribed && len(h.Problems) == 0
+}
+
+// CheckSubscription inspects the config, events and latest delivery of the sicuro webhook i.e the one posting
+// to params.CallbackURL on the given repo. The secret can't be compared as github hides it; it's only
+// checked to be set
+func (client *GithubClient) CheckSubscription(params GithubRequestParams) (*SubscriptionHealth, error) {
+	health, _, err := client.CheckSubscriptionIfChanged(params, "")
+	return health, err
+}
+
+// CheckSubscriptionIfChanged is CheckSubscription conditional on the repo's webhooks having changed since they
+// were listed with the given ETag. It returns a nil health if they haven't, along with the ETag of the listing
+func (client *GithubClient) CheckSubscriptionIfChanged(params GithubRequestParams, etag string) (*SubscriptionHealth, string, error) {
+	hooks, etag, err := client.listHooks(params, etag)
+	if err != nil {
+		return &SubscriptionHealth{}, "", err
+	}
+	if hooks == nil {
+		return nil, etag, nil
+	}
+
+	hook := matchingHook(hooks, params.CallbackURL)
+	if hook == nil {
+		return &SubscriptionHealth{}, etag, nil
+	}
+
+	health := &SubscriptionHealth{Subscribed: true, HookID: hook.ID, LastResponse: hook.LastResponse}
+	if !hook.Active {
+		health.Problems = append(health.Problems, "the webhook is inactive")
+	}
+	if missing := missingEvents(hook.Events); len(missing) > 0 {
+		health.Problems = append(health.Problems, "the webhook isn't sent for: "+strings.Join(missing, ", "))
+	}
+	if hook.Config["content_type"] != "json" {
+		health.Problems = append(health.Problems, "the webhook isn't sent as json")
+	}
+	if secret, _ := hook.Config["secret"].(string); secret == "" && params.Creds != "" {
+		health.Problems = append(health.Problems, "the webhook has no secret")
+	}
+	if code := hook.LastResponse.Code; code != nil && (*code < 200 || *code >= 300) {
+		health.Problems = append(health.Problems, fmt.Sprintf("the last delivery failed: %d %s", *code, hook.LastResponse.Message))
+	}
+	return health, etag, nil
+}
+
+// RepairSubscription updates the sicuro webhook on the given repo in place so it's active, delivers the
+// events sicuro needs as json and is signed with params.Creds. The repo is subscribed if it has no webhook
+func (client *GithubClient) RepairSubscription(params GithubRequestParams) error {
+	hook, err := client.findHook(params)
+	if err != nil {
+		return err
+	}
+	if hook == nil {
+		return client.Subscribe(params)
+	}
+
+	events := append([]string{}, hook.Events...)
+	events = append(events, missingEvents(hook.Events)...)
+	edit := &github.Hook{
+		Active: github.Bool(true),
+		Events: events,
+		Config: webhookConfig(params),
+	}
+
+	if _, _, err := client.Repositories.EditHook(ctx, params.Owner, params.Repo, hook.ID, edit); err != nil {
+		log.Printf("Error %s occurred while repairing webhook %d with params %v", err, hook.ID, params)
+		return err
+	}
+	return nil
+}
+
+// findHook returns the repo's webhook posting to params.CallbackURL or nil if there's none
+func (client *GithubClient) findHook(params GithubRequestParams) (*hookStatus, error) {
+	hooks, _, err := client.listHooks(params, "")
+	if err != nil {
+		return nil, err
+	}
+	return matchingHook(hooks, params.CallbackURL), nil
+}
+
+// listHooks lists the repo's webhooks unless they haven't changed since they were listed with the given ETag
+// It returns nil hooks if they haven't, along with the ETag of the listing
+func (client *GithubClient) listHooks(params GithubRequestParams, etag string) ([]*hookStatus, string, error) {
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%s/%s/hooks", params.Owner, params.Repo), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	hooks := []*hookStatus{}
+	resp, err := client.Do(ctx, req, &hooks)
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	if err != nil {
+		log.Printf("Error %s occurred while listing webhooks with params %v", err, params)
+		return nil, "", err
+	}
+	return hooks, resp.Header.Get("ETag"), nil
+}
+
+func matchingHook(hooks []*hookStatus, callbackURL string) *hookStatus {
+	for _, hook := range hooks {
+		if hook.Config["url"] == callbackURL {
+			return hook
+		}
+	}
+	return nil
+}
+
+func webhookConfig(params GithubRequestParams) map[string]interface{} {
+	return map[string]interface{}{
+		"content_type": "json",
+		"url":          params.CallbackURL,
+		"secret":       params.Creds,
+	}
+}
+
+// missingEvents returns the webhook events sicuro needs that aren't in events
+// A webhook sent for every event i.e * misses none
+func missingEvents(events []string) []string {
+	subscribed := map[string]bool{}
+	for _, e := range events {
+		subscribed[e] = true
+	}
+	if subscribed["*"] {
+		return nil
+	}
+
+	missing := []string{}
+	for _, e := range webhookEvents {
+		if !subscribed[e] {
+			missing = append(missing, e)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,80 @@
+package vcs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// newTestClient returns a client of the github API served by handler
+func newTestClient(t *testing.T, handler http.Handler) (*GithubClient, func()) {
+	server := httptest.NewServer(handler)
+	client := &GithubClient{github.NewClient(nil)}
+	base, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = base
+	return client, server.Close
+}
+
+func TestMissingEvents(t *testing.T) {
+	cases := []struct {
+		events []string
+		want   []string
+	}{
+		{[]string{"push", "pull_request", "create", "delete"}, []string{}},
+		{[]string{"delete", "issues", "create", "pull_request", "push"}, []string{}},
+		{[]string{"*"}, nil},
+		{[]string{"push"}, []string{"pull_request", "create", "delete"}},
+		{nil, webhookEvents},
+	}
+
+	for _, c := range cases {
+		if got := missingEvents(c.events); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("missingEvents(%v) = %v; want %v", c.events, got, c.want)
+		}
+	}
+}
+
+func TestCheckSubscription(t *testing.T) {
+	hooks := `[
+		{"id": 1, "active": true, "events": ["*"], "config": {"url": "https://ci.example.com/other", "content_type": "json"}},
+		{"id": 2, "active": false, "events": ["push"], "config": {"url": "https://sicuro.example.com/gh/webhook", "content_type": "form"},
+		 "last_response": {"code": 502, "status": "failed", "message": "Bad Gateway"}}
+	]`
+	client, done := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/octocat/hello/hooks" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(hooks))
+	}))
+	defer done()
+
+	params := GithubRequestParams{Owner: "octocat", Repo: "hello", CallbackURL: "https://sicuro.example.com/gh/webhook", Creds: "secret"}
+	health, err := client.CheckSubscription(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"the webhook is inactive",
+		"the webhook isn't sent for: pull_request, create, delete",
+		"the webhook isn't sent as json",
+		"the webhook has no secret",
+		"the last delivery failed: 502 Bad Gateway",
+	}
+	if !health.Subscribed || health.HookID != 2 || health.Healthy() || !reflect.DeepEqual(health.Problems, want) {
+		t.Errorf("CheckSubscription() = %+v; want hook 2 with problems %q", health, want)
+	}
+
+	params.CallbackURL = "https://elsewhere.example.com/gh/webhook"
+	if health, err := client.CheckSubscription(params); err != nil || health.Subscribed {
+		t.Errorf("CheckSubscription() of an unsubscribed repo = %+v, %v; want it unsubscribed", health, err)
+	}
+}
@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/0sc/sicuro/ci"
+	"gopkg.in/go-playground/webhooks.v3/github"
+)
+
+// branchTrigger is the trigger of the builds of pushes to the branch
+func branchTrigger(branch string) string {
+	return "push refs/heads/" + branch
+}
+
+// archiveBranch cancels the builds of a deleted branch and marks it archived
+// It returns a description of what was done
+func archiveBranch(project, branch string) string {
+	cancelled := ci.CancelTriggered(project, branchTrigger(branch))
+	ci.ArchiveBranch(project, branch)
+	return fmt.Sprintf("branch %s deleted; cancelled %d builds", branch, len(cancelled))
+}
+
+// handleDeleteEvent archives deleted branches
+func handleDeleteEvent(payload []byte) (string, error) {
+	evt := github.DeletePayload{}
+	if err := json.Unmarshal(payload, &evt); err != nil {
+		return "", err
+	}
+
+	if evt.RefType != "branch" {
+		return fmt.Sprintf("%s %s deleted", evt.RefType, evt.Ref), nil
+	}
+	return archiveBranch(evt.Repository.FullName, evt.Ref), nil
+}
+
+// handleCreateEvent restores created branches that were previously archived
+// The branch is built when its commits are pushed
+func handleCreateEvent(payload []byte) (string, error) {
+	evt := github.CreatePayload{}
+	if err := json.Unmarshal(payload, &evt); err != nil {
+		return "", err
+	}
+
+	if evt.RefType == "branch" {
+		ci.RestoreBranch(evt.Repository.FullName, evt.Ref)
+	}
+	return fmt.Sprintf("%s %s created", evt.RefType, evt.Ref), nil
+}
@@ -0,0 +1,306 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/0sc/sicuro/store"
+)
+
+// Outcome describes what became of a webhook delivery
+type Outcome string
+
+const (
+	// OutcomeQueued is the outcome of a delivery that resulted in a build
+	OutcomeQueued Outcome = "queued"
+	// OutcomeCoalesced is the outcome of a delivery linked to an existing build of the same commit
+	OutcomeCoalesced Outcome = "coalesced"
+	// OutcomeDuplicate is the outcome of a delivery github has already sent and sicuro has handled
+	// Duplicates aren't logged; the original delivery is kept
+	OutcomeDuplicate Outcome = "duplicate"
+	// OutcomeIgnored is the outcome of a delivery for an event sicuro doesn't build
+	OutcomeIgnored Outcome = "ignored"
+	// OutcomeSkipped is the outcome of a delivery the project's config says not to build
+	OutcomeSkipped Outcome = "skipped"
+	// OutcomeMalformed is the outcome of a request that isn't a github webhook delivery e.g missing headers
+	OutcomeMalformed Outcome = "malformed"
+	// OutcomeRejected is the outcome of a delivery with a missing or invalid signature
+	OutcomeRejected Outcome = "rejected"
+	// OutcomeError is the outcome of a delivery whose job couldn't be built from the payload
+	OutcomeError Outcome = "error"
+)
+
+const (
+	// MaxPayloadSize is the size of the largest webhook payload read; github caps payloads at 25MB
+	MaxPayloadSize = 25 << 20
+	// maxDeliveries is the number of deliveries kept in the log
+	// The oldest deliveries are dropped once it's exceeded
+	maxDeliveries = 200
+	// maxRejections is the number of rejected requests kept; they're logged apart from the deliveries
+	// so requests that didn't come from github can't push deliveries out of the log
+	maxRejections = 50
+	// maxRejectedPayload is how much of the payload of a rejected request is kept
+	maxRejectedPayload = 4 << 10
+)
+
+var (
+	deliveries = store.New("webhook_deliveries")
+	// payloads holds the payloads of the logged deliveries keyed by delivery ID
+	// They're kept apart from the records so logging a delivery doesn't rewrite every payload
+	payloads   = store.NewBlobs("webhook_payloads")
+	rejections = store.New("webhook_rejections")
+	// deliveryMu guards checking whether a delivery has been handled and claiming it
+	deliveryMu sync.Mutex
+	// claimed are the IDs of the deliveries being handled
+	claimed = map[string]bool{}
+)
+
+// Delivery is the record of a webhook request received from github and what became of it
+type Delivery struct {
+	// ID is the github delivery ID; replays get an ID derived from the original's
+	ID      string
+	Event   string
+	Headers http.Header
+	// Payload is only stored in the record of rejected requests; see DeliveryPayload
+	Payload    string `json:",omitempty"`
+	ReceivedAt time.Time
+	// ReplayOf is the ID of the delivery this is a replay of, if any
+	ReplayOf string
+	Outcome  Outcome
+	// Error describes why the delivery was rejected, errored or skipped
+	Error string
+	// Build is the name of the build the delivery resulted in, if any
+	Build string
+	// Host is the host the delivery was sent to; builds link back to it
+	Host string
+}
+
+// newDelivery records the details of the webhook request
+// It reads the request body and resets it so it can be read again
+func newDelivery(req *http.Request) (*Delivery, error) {
+	payload, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+
+	d := &Delivery{
+		ID:         req.Header.Get("X-GitHub-Delivery"),
+		Event:      req.Header.Get("X-GitHub-Event"),
+		Host:       req.Host,
+		Headers:    req.Header,
+		Payload:    string(payload),
+		ReceivedAt: time.Now(),
+	}
+	if d.ID == "" {
+		d.ID = fmt.Sprintf("unidentified-%d", d.ReceivedAt.UnixNano())
+	}
+	return d, nil
+}
+
+// DeliveryPayload returns the payload of the logged delivery with the given id
+func DeliveryPayload(id string) (string, error) {
+	d := findDelivery(id)
+	if d == nil {
+		return "", fmt.Errorf("no webhook delivery with id %s", id)
+	}
+	return d.payload()
+}
+
+// payload returns the delivery's payload, reading it from the payloads if it isn't in the record
+func (d *Delivery) payload() (string, error) {
+	if d.Payload != "" {
+		return d.Payload, nil
+	}
+
+	data, found, err := payloads.Get(d.ID)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("the payload of webhook delivery %s is missing", d.ID)
+	}
+	return string(data), nil
+}
+
+// findDelivery returns the logged delivery with the given id or nil if there's none
+func findDelivery(id string) *Delivery {
+	d := &Delivery{}
+	found, err := deliveries.Get(id, d)
+	if err != nil {
+		log.Printf("Error: %s occurred while fetching webhook delivery %s\n", err, id)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	return d
+}
+
+// handled returns true if the delivery was processed and needn't be processed again
+// Deliveries that were malformed, rejected or errored can be retried
+func (d *Delivery) handled() bool {
+	switch d.Outcome {
+	case OutcomeMalformed, OutcomeRejected, OutcomeError:
+		return false
+	}
+	return true
+}
+
+// Result returns a summary of what became of the delivery
+func (d *Delivery) Result() *Result {
+	return &Result{
+		Outcome:  d.Outcome,
+		Delivery: d.ID,
+		Event:    d.Event,
+		Build:    d.Build,
+		Reason:   d.Error,
+	}
+}
+
+// request rebuilds the original webhook request from the delivery
+func (d *Delivery) request() *http.Request {
+	req, _ := http.NewRequest("POST", "/", bytes.NewReader([]byte(d.Payload)))
+	req.Header = d.Headers
+	req.Host = d.Host
+	return req
+}
+
+func (d *Delivery) finish(outcome Outcome, err error) {
+	d.Outcome = outcome
+	if err != nil {
+		d.Error = err.Error()
+	}
+	log.Printf("Webhook delivery %s for %s event: %s %s\n", d.ID, d.Event, d.Outcome, d.Error)
+}
+
+func (d *Delivery) save() {
+	if err := payloads.Put(d.ID, []byte(d.Payload)); err != nil {
+		log.Printf("Error: %s occurred while saving the payload of webhook delivery %s\n", err, d.ID)
+		return
+	}
+
+	record := *d
+	record.Payload = ""
+	if err := deliveries.Put(d.ID, record); err != nil {
+		log.Printf("Error: %s occurred while saving webhook delivery %s\n", err, d.ID)
+		return
+	}
+	pruneDeliveries()
+}
+
+// saveRejected logs the malformed or rejected request apart from the deliveries, truncating its payload
+func (d *Delivery) saveRejected() {
+	if len(d.Payload) > maxRejectedPayload {
+		d.Payload = d.Payload[:maxRejectedPayload]
+	}
+
+	// requests that aren't from github can reuse delivery IDs
+	key := fmt.Sprintf("%s-%d", d.ID, d.ReceivedAt.UnixNano())
+	if err := rejections.Put(key, d); err != nil {
+		log.Printf("Error: %s occurred while saving rejected webhook request %s\n", err, d.ID)
+		return
+	}
+	prune(rejections, maxRejections)
+}
+
+func pruneDeliveries() {
+	for _, id := range prune(deliveries, maxDeliveries) {
+		if err := payloads.Delete(id); err != nil {
+			log.Printf("Error: %s occurred while pruning the payload of webhook delivery %s\n", err, id)
+		}
+	}
+}
+
+// prune drops the oldest records of the collection past the first max, returning their keys
+// Only the records' metadata is read; delivery payloads are kept apart
+func prune(c *store.Collection, max int) []string {
+	keys, all := listDeliveries(c)
+	pruned := []string{}
+	for i := max; i < len(all); i++ {
+		if err := c.Delete(keys[all[i]]); err != nil {
+			log.Printf("Error: %s occurred while pruning webhook delivery %s\n", err, all[i].ID)
+			continue
+		}
+		pruned = append(pruned, keys[all[i]])
+	}
+	return pruned
+}
+
+// Deliveries returns the logged webhook deliveries, most recent first, without their payloads
+func Deliveries() []*Delivery {
+	_, all := listDeliveries(deliveries)
+	return all
+}
+
+// Rejections returns the logged requests that were malformed or failed signature validation, most recent first
+func Rejections() []*Delivery {
+	_, all := listDeliveries(rejections)
+	return all
+}
+
+// listDeliveries returns the deliveries in the collection, most recent first, along with their keys
+func listDeliveries(c *store.Collection) (map[*Delivery]string, []*Delivery) {
+	keys := map[*Delivery]string{}
+	all := []*Delivery{}
+	ids, err := c.Keys()
+	if err != nil {
+		log.Println("Error occurred while listing webhook deliveries: ", err)
+		return keys, all
+	}
+
+	for _, id := range ids {
+		d := &Delivery{}
+		if _, err := c.Get(id, d); err != nil {
+			log.Printf("Error: %s occurred while reading webhook delivery %s\n", err, id)
+			continue
+		}
+		keys[d] = id
+		all = append(all, d)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ReceivedAt.After(all[j].ReceivedAt)
+	})
+	return keys, all
+}
+
+// Replay processes the logged delivery with the given id again as though it was just received
+// The replay is logged as a new delivery which is returned
+func Replay(id string) (*Delivery, error) {
+	orig := findDelivery(id)
+	if orig == nil {
+		return nil, fmt.Errorf("no webhook delivery with id %s", id)
+	}
+	payload, err := orig.payload()
+	if err != nil {
+		return nil, err
+	}
+
+	// replays get their own IDs so they needn't be claimed
+	d := &Delivery{
+		Event:      orig.Event,
+		Host:       orig.Host,
+		Headers:    orig.Headers,
+		Payload:    payload,
+		ReceivedAt: time.Now(),
+		ReplayOf:   orig.ID,
+	}
+	d.ID = fmt.Sprintf("%s-replay-%d", orig.ID, d.ReceivedAt.UnixNano())
+
+	hook := parse(d, d.request())
+	if hook == nil {
+		d.saveRejected()
+		return d, nil
+	}
+	process(d, hook)
+	d.save()
+	return d, nil
+}
@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMalformedRequestsAreLoggedAsRejections(t *testing.T) {
+	payload := strings.Repeat("x", maxRejectedPayload+10)
+	req := httptest.NewRequest("POST", "/gh/webhook", strings.NewReader(payload))
+
+	res := GithubWebhookHandler(req)
+	if res.Outcome != OutcomeMalformed {
+		t.Fatalf("request without github headers got outcome %s; want %s", res.Outcome, OutcomeMalformed)
+	}
+
+	if n := len(Deliveries()); n != 0 {
+		t.Errorf("%d deliveries were logged; want rejected requests kept out of the delivery log", n)
+	}
+	rejected := Rejections()
+	if len(rejected) != 1 {
+		t.Fatalf("%d rejections were logged; want 1", len(rejected))
+	}
+	if len(rejected[0].Payload) != maxRejectedPayload {
+		t.Errorf("rejected payload is %d bytes; want it truncated to %d", len(rejected[0].Payload), maxRejectedPayload)
+	}
+}
+
+func TestRejectionsAreCapped(t *testing.T) {
+	for i := 0; i < maxRejections+5; i++ {
+		req := httptest.NewRequest("POST", "/gh/webhook", strings.NewReader("{}"))
+		// the same delivery ID is reused by every request
+		req.Header.Set("X-GitHub-Delivery", "spoofed")
+		GithubWebhookHandler(req)
+	}
+
+	if n := len(Rejections()); n != maxRejections {
+		t.Errorf("%d rejections are kept; want %d", n, maxRejections)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	d := &Delivery{ID: "claim-1", Event: "push"}
+	if res := claim(d); res != nil {
+		t.Fatalf("first claim returned %v; want nil", res)
+	}
+
+	// a retry arriving while the delivery is being handled
+	if res := claim(&Delivery{ID: "claim-1", Event: "push"}); res == nil || res.Outcome != OutcomeDuplicate {
+		t.Errorf("claim of an in-flight delivery returned %v; want a duplicate", res)
+	}
+
+	d.finish(OutcomeError, nil)
+	d.save()
+	release(d)
+	if res := claim(&Delivery{ID: "claim-1", Event: "push"}); res != nil {
+		t.Errorf("claim of a delivery that errored returned %v; want it to be retried", res)
+	}
+
+	handled := &Delivery{ID: "claim-2", Event: "push", Build: "o/r/builds/1"}
+	handled.finish(OutcomeQueued, nil)
+	handled.save()
+	if res := claim(&Delivery{ID: "claim-2"}); res == nil || res.Outcome != OutcomeDuplicate || res.Build != handled.Build {
+		t.Errorf("claim of a handled delivery returned %v; want a duplicate of build %s", res, handled.Build)
+	}
+}
+
+func TestDeliveryPayloadsAreStoredApart(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	oldest := &Delivery{ID: "payload-0", Event: "push", Payload: `{"ref": "refs/heads/master"}`, ReceivedAt: start}
+	oldest.finish(OutcomeIgnored, nil)
+	oldest.save()
+
+	if d := findDelivery(oldest.ID); d == nil || d.Payload != "" {
+		t.Fatalf("findDelivery() = %+v; want the record without its payload", d)
+	}
+	if payload, err := DeliveryPayload(oldest.ID); err != nil || payload != oldest.Payload {
+		t.Errorf("DeliveryPayload() = %q, %v; want %q", payload, err, oldest.Payload)
+	}
+
+	for i := 1; i <= maxDeliveries; i++ {
+		d := &Delivery{ID: fmt.Sprintf("payload-%d", i), Event: "push", Payload: "{}", ReceivedAt: start.Add(time.Duration(i) * time.Second)}
+		d.finish(OutcomeIgnored, nil)
+		d.save()
+	}
+	if findDelivery(oldest.ID) != nil {
+		t.Error("the oldest delivery wasn't pruned")
+	}
+	if _, found, _ := payloads.Get(oldest.ID); found {
+		t.Error("the payload of the pruned delivery was kept")
+	}
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"log"
+	"regexp"
+	"strings"
+)
+
+const (
+	// directiveSkip skips the build e.g [skip ci] or [ci skip]
+	directiveSkip = "skip"
+	// directiveRebuildCache clears the project's dependency cache before the build e.g [ci rebuild-cache]
+	directiveRebuildCache = "rebuild-cache"
+)
+
+// FetchCommitMessage retrieves the message of the commit with the given sha
+// It's used for events whose payloads don't include the commit message e.g pull requests
+// It's set by the app; directives are only read from payloads while it's nil
+var FetchCommitMessage func(owner, repo, sha string) (string, error)
+
+var (
+	// skipDirective matches the commit message markers for skipping a build
+	skipDirective = regexp.MustCompile(`(?i)\[(skip ci|ci skip|no ci|skip sicuro|sicuro skip)\]`)
+	// ciDirective matches other directives of the form [ci <directive>]
+	ciDirective = regexp.MustCompile(`(?i)\[ci ([a-z-]+)\]`)
+)
+
+// parseDirectives returns the set of directives found in the commit messages
+func parseDirectives(messages []string) map[string]bool {
+	directives := map[string]bool{}
+	for _, msg := range messages {
+		if skipDirective.MatchString(msg) {
+			directives[directiveSkip] = true
+		}
+		for _, match := range ciDirective.FindAllStringSubmatch(msg, -1) {
+			directives[strings.ToLower(match[1])] = true
+		}
+	}
+	return directives
+}
+
+// commitMessages returns the messages of the event's head commit
+// fetching them if they weren't in the payload
+func (job *eventJob) commitMessages() []string {
+	if job.messages != nil || FetchCommitMessage == nil {
+		return job.messages
+	}
+
+	msg, err := FetchCommitMessage(job.owner, job.repo, job.sha)
+	if err != nil {
+		log.Printf("Error: %s occurred while fetching the message of commit %s for %s/%s\n", err, job.sha, job.owner, job.repo)
+		return nil
+	}
+	job.messages = []string{msg}
+	return job.messages
+}
+
+// applyDirectives sets the directives found in the event's commit messages on the job
+func (job *eventJob) applyDirectives() {
+	job.directives = parseDirectives(job.commitMessages())
+	job.RebuildCache = job.directives[directiveRebuildCache]
+}
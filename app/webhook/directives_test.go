@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/0sc/sicuro/ci"
+)
+
+func TestParseDirectives(t *testing.T) {
+	cases := []struct {
+		messages []string
+		want     map[string]bool
+	}{
+		{nil, map[string]bool{}},
+		{[]string{"fix the login form"}, map[string]bool{}},
+		{[]string{"fix the login form [skip ci]"}, map[string]bool{directiveSkip: true}},
+		{[]string{"update docs\n\n[Skip Sicuro]"}, map[string]bool{directiveSkip: true}},
+		{[]string{"[no ci] bump version"}, map[string]bool{directiveSkip: true}},
+		{[]string{"bump deps [ci rebuild-cache]"}, map[string]bool{directiveRebuildCache: true}},
+		{[]string{"[CI Rebuild-Cache]"}, map[string]bool{directiveRebuildCache: true}},
+		// directives are gathered from all the messages
+		{
+			[]string{"bump deps [ci rebuild-cache]", "wip [ci skip]"},
+			map[string]bool{directiveRebuildCache: true, directiveSkip: true},
+		},
+		// brackets without the ci marker aren't directives
+		{[]string{"[skip] [rebuild-cache]"}, map[string]bool{}},
+	}
+
+	for _, c := range cases {
+		if got := parseDirectives(c.messages); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseDirectives(%q) = %v; want %v", c.messages, got, c.want)
+		}
+	}
+}
+
+func TestApplyDirectivesFetchesMissingMessages(t *testing.T) {
+	defer func(fetch func(owner, repo, sha string) (string, error)) { FetchCommitMessage = fetch }(FetchCommitMessage)
+
+	fetched := 0
+	FetchCommitMessage = func(owner, repo, sha string) (string, error) {
+		fetched++
+		if sha != "abc123" {
+			return "", errors.New("unknown commit")
+		}
+		return "bump deps [ci rebuild-cache]", nil
+	}
+
+	job := &eventJob{JobDetails: &ci.JobDetails{}, owner: "octocat", repo: "hello", sha: "abc123"}
+	job.applyDirectives()
+	if !job.RebuildCache || fetched != 1 {
+		t.Errorf("applyDirectives() set RebuildCache %t after %d fetches; want true after 1", job.RebuildCache, fetched)
+	}
+	job.commitMessages()
+	if fetched != 1 {
+		t.Errorf("commit message fetched %d times; want it fetched once", fetched)
+	}
+
+	// messages in the payload are used as they are
+	job = &eventJob{JobDetails: &ci.JobDetails{}, sha: "abc123", messages: []string{"wip [skip ci]"}}
+	job.applyDirectives()
+	if !job.directives[directiveSkip] || job.RebuildCache || fetched != 1 {
+		t.Errorf("applyDirectives() = %v after %d fetches; want only skip without fetching", job.directives, fetched)
+	}
+
+	// a failed fetch leaves the job without directives
+	job = &eventJob{JobDetails: &ci.JobDetails{}, sha: "def456"}
+	job.applyDirectives()
+	if len(job.directives) != 0 || job.messages != nil {
+		t.Errorf("applyDirectives() = %v, messages %v after a failed fetch; want none", job.directives, job.messages)
+	}
+}
@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/0sc/sicuro/ci"
+)
+
+// FetchConfig retrieves the content of the sicuro.json file of the repo at the given ref
+// It should return nil content and no error if the repo has no config file
+// It's set by the app; the default config is used while it's nil
+var FetchConfig func(owner, repo, ref string) ([]byte, error)
+
+// eventJob is the job built from a webhook event
+// along with the event details used to decide whether it should run
+type eventJob struct {
+	*ci.JobDetails
+	owner string
+	repo  string
+	sha   string
+	// branch is the branch the config's branch filters are evaluated against
+	// It's empty if the filters don't apply to the event
+	branch string
+	// files are the files changed by the event; empty if they aren't known
+	files []string
+	// action is the pull request action e.g opened; it's empty for other events
+	action string
+	// pullRequest is the number of the pull request; it's 0 for other events
+	pullRequest int64
+	// mergeSHA is github's merge commit for the pull request, if it's been computed
+	mergeSHA string
+	// baseSHA is the commit of the branch the pull request would be merged into
+	baseSHA string
+	// mergeable is false if the pull request conflicts with its base; nil until github has checked
+	mergeable *bool
+	// deleted is true if the event is a push deleting the branch or tag
+	deleted bool
+	// messages are the commit messages to read directives from
+	// It's nil if they weren't in the payload and have to be fetched
+	messages   []string
+	directives map[string]bool
+}
+
+// project returns the job's repo in the form owner/repo
+func (job *eventJob) project() string {
+	return job.owner + "/" + job.repo
+}
+
+// config fetches the project's config at the event's commit
+// The default config is returned if it can't be fetched
+func (job *eventJob) config() *ci.Config {
+	cfg := &ci.Config{}
+	if FetchConfig == nil {
+		return cfg
+	}
+
+	data, err := FetchConfig(job.owner, job.repo, job.sha)
+	if err != nil {
+		log.Printf("Error: %s occurred while fetching %s for %s/%s; using the default\n", err, ci.ConfigFileName, job.owner, job.repo)
+		return cfg
+	}
+
+	if cfg, err = ci.ParseConfig(data); err != nil {
+		log.Printf("Error: %s occurred while parsing %s for %s/%s; using the default\n", err, ci.ConfigFileName, job.owner, job.repo)
+		return &ci.Config{}
+	}
+	return cfg
+}
+
+// useMergeRef has the job test the result of merging the pull request into its base
+// The build is kept apart from builds of the head commit and from merges into other base commits;
+// statuses are still reported on the head commit
+func (job *eventJob) useMergeRef() {
+	job.ProjectRef = fmt.Sprintf("refs/pull/%d/merge", job.pullRequest)
+	job.MergeSHA = job.mergeSHA
+	job.BuildKey += "-merge-" + job.baseSHA
+}
+
+// conflicted returns true if the job builds the merge of a pull request github can't merge
+func (job *eventJob) conflicted() bool {
+	return job.ProjectRef != "" && job.mergeable != nil && !*job.mergeable
+}
+
+// ignoreReason returns why the event isn't one the project builds
+// It returns an empty string if it is
+func (job *eventJob) ignoreReason(cfg *ci.Config) string {
+	if job.action != "" && !cfg.PullRequests.Builds(job.action) {
+		return fmt.Sprintf("pull request action %s isn't built", job.action)
+	}
+	return ""
+}
+
+// supersedes returns true if the job replaces the earlier builds linked to its trigger
+// i.e it's for a push to a branch or a pull request, not a tag, ping or manual build
+func (job *eventJob) supersedes() bool {
+	return job.pullRequest != 0 || strings.HasPrefix(job.Trigger, "push ")
+}
+
+// skipReason returns why the job shouldn't run according to the config
+// It returns an empty string if the job should run
+func (job *eventJob) skipReason(cfg *ci.Config) string {
+	if job.directives[directiveSkip] {
+		return "the commit message asks for the build to be skipped"
+	}
+	if job.conflicted() {
+		return fmt.Sprintf("pull request #%d has conflicts with %s so there's no merge to build", job.pullRequest, job.branch)
+	}
+	if job.branch != "" && !cfg.Branches.Allows(job.branch) {
+		return fmt.Sprintf("branch %s is filtered out by the branches config", job.branch)
+	}
+	if !cfg.Paths.Allows(job.files) {
+		return "none of the changed files match the paths config"
+	}
+	return ""
+}
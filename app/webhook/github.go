@@ -2,27 +2,107 @@ package webhook
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/0sc/sicuro/ci"
 	"gopkg.in/go-playground/webhooks.v3/github"
 	githubhook "gopkg.in/rjz/githubhook.v0"
 )
 
-func GithubWebhookHandler(req *http.Request) {
+// Result is a summary of what became of a webhook request
+type Result struct {
+	Outcome  Outcome `json:"outcome"`
+	Delivery string  `json:"delivery,omitempty"`
+	Event    string  `json:"event,omitempty"`
+	// Build is the name of the build the request was accepted as, if any
+	Build string `json:"build,omitempty"`
+	// Reason explains why the request was rejected, if it was
+	Reason string `json:"reason,omitempty"`
+}
+
+// GithubWebhookHandler handles the webhook requests from github
+// Every delivery with a valid signature is logged along with its outcome; other requests are logged as rejections
+// Github retries deliveries; a delivery that's already been handled is skipped
+// The request body should be limited to MaxPayloadSize
+func GithubWebhookHandler(req *http.Request) *Result {
+	d, err := newDelivery(req)
+	if err != nil {
+		log.Println("Error reading webhook request", err)
+		return &Result{Outcome: OutcomeMalformed, Reason: err.Error()}
+	}
+
+	hook := parse(d, req)
+	if hook == nil {
+		d.saveRejected()
+		return d.Result()
+	}
+
+	if dup := claim(d); dup != nil {
+		return dup
+	}
+	defer release(d)
+
+	process(d, hook)
+	d.save()
+	return d.Result()
+}
+
+// claim marks the delivery as being handled so retries of it arriving meanwhile are skipped
+// It returns the result of the duplicate if the delivery has already been handled or is being handled
+func claim(d *Delivery) *Result {
+	deliveryMu.Lock()
+	defer deliveryMu.Unlock()
+
+	if prev := findDelivery(d.ID); prev != nil && prev.handled() {
+		d.finish(OutcomeDuplicate, nil)
+		res := prev.Result()
+		res.Outcome = OutcomeDuplicate
+		return res
+	}
+	if claimed[d.ID] {
+		d.finish(OutcomeDuplicate, nil)
+		return &Result{Outcome: OutcomeDuplicate, Delivery: d.ID, Event: d.Event}
+	}
+
+	claimed[d.ID] = true
+	return nil
+}
+
+// release lets the delivery be handled again; it's called once the delivery's outcome has been saved
+// Deliveries that weren't handled e.g because they errored can then be retried
+func release(d *Delivery) {
+	deliveryMu.Lock()
+	defer deliveryMu.Unlock()
+	delete(claimed, d.ID)
+}
+
+// parse validates the webhook request's headers and signature
+// It returns nil, recording why on the delivery, if the request isn't a valid github delivery
+func parse(d *Delivery, req *http.Request) *githubhook.Hook {
+	if err := validateHeaders(req); err != nil {
+		d.finish(OutcomeMalformed, err)
+		return nil
+	}
+
 	secret := []byte(os.Getenv("GITHUB_WEBHOOK_SECRET"))
 	hook, err := githubhook.Parse(secret, req)
 	if err != nil {
-		fmt.Println("Error parsing webhook", err)
-		return
+		d.finish(OutcomeRejected, err)
+		return nil
 	}
+	return hook
+}
 
-	fmt.Println("Received a ", hook.Event, "event")
-
-	var job *ci.JobDetails
+// process runs the job for the validated delivery's event recording the outcome on the delivery
+func process(d *Delivery, hook *githubhook.Hook) {
+	var job *eventJob
+	var err error
 
 	switch hook.Event {
 	case "ping":
@@ -31,77 +111,287 @@ func GithubWebhookHandler(req *http.Request) {
 		job, err = buildPushEventJob(hook.Payload)
 	case string(github.PullRequestEvent):
 		job, err = buildPREventJob(hook.Payload)
+	case string(github.DeleteEvent):
+		finishRefEvent(d, handleDeleteEvent, hook.Payload)
+		return
+	case string(github.CreateEvent):
+		finishRefEvent(d, handleCreateEvent, hook.Payload)
+		return
+	default:
+		d.finish(OutcomeIgnored, nil)
+		return
 	}
 
 	if err != nil {
-		fmt.Printf("Build job error for %s event. Error: %s\n", hook.Event, err)
+		d.finish(OutcomeError, err)
 		return
 	}
 
-	ci.Run(job)
+	if job.deleted && job.Tag != "" {
+		d.finish(OutcomeIgnored, fmt.Errorf("tag %s deleted", job.Tag))
+		return
+	}
+	if job.deleted {
+		d.finish(OutcomeIgnored, errors.New(archiveBranch(job.project(), job.branch)))
+		return
+	}
+
+	if job.action == "closed" {
+		cancelled := ci.CancelTriggered(job.project(), job.Trigger)
+		d.finish(OutcomeIgnored, fmt.Errorf("pull request closed; cancelled %d builds", len(cancelled)))
+		return
+	}
+
+	cfg := job.config()
+	if reason := job.ignoreReason(cfg); reason != "" {
+		d.finish(OutcomeIgnored, errors.New(reason))
+		return
+	}
+
+	if job.pullRequest != 0 && cfg.PullRequests.BuildMerge {
+		job.useMergeRef()
+	}
+	if job.Tag != "" {
+		job.Deploy = cfg.Deploy.Deploys(job.Tag)
+	}
+	job.Steps = cfg.Statuses.Steps
+	job.SummaryComment = cfg.PullRequests.SummaryComment
+	if Reporters != nil {
+		host, owner, repo, sha := d.Host, job.owner, job.repo, job.sha
+		job.SetReporters = func(j *ci.JobDetails) {
+			Reporters(j, host, owner, repo, sha)
+		}
+	}
+
+	job.applyDirectives()
+	job.describe()
+	if reason := job.skipReason(cfg); reason != "" {
+		// a conflict is always reported; the pull request would otherwise never get a status
+		ci.Skip(job.JobDetails, reason, cfg.ReportSkipped || job.conflicted())
+		d.Build = job.LogFileName
+		d.finish(OutcomeSkipped, errors.New(reason))
+		return
+	}
+
+	// a push and a pull request for the same commit resolve to the same build
+	// unless the delivery is replayed, which is asked for to build the event again
+	coalesced := false
+	if d.ReplayOf != "" {
+		ci.Run(job.JobDetails)
+	} else {
+		coalesced = ci.RunOrLink(job.JobDetails)
+	}
+	d.Build = job.LogFileName
+	if cfg.AutoCancel && job.supersedes() {
+		if cancelled := ci.CancelSuperseded(job.JobDetails); len(cancelled) > 0 {
+			log.Printf("Cancelled builds %v superseded by %s\n", cancelled, job.LogFileName)
+		}
+	}
+
+	if coalesced {
+		if job.pullRequest != 0 && job.SummaryComment && LinkedPullRequest != nil {
+			LinkedPullRequest(job.JobDetails, d.Host, job.owner, job.repo, job.pullRequest)
+		}
+		d.finish(OutcomeCoalesced, nil)
+		return
+	}
+	d.finish(OutcomeQueued, nil)
+}
+
+// finishRefEvent handles a branch or tag event that never results in a build
+func finishRefEvent(d *Delivery, handle func([]byte) (string, error), payload []byte) {
+	desc, err := handle(payload)
+	if err != nil {
+		d.finish(OutcomeError, err)
+		return
+	}
+	d.finish(OutcomeIgnored, errors.New(desc))
+}
+
+// validateHeaders checks the request has the headers identifying a github delivery
+// The signature is checked when the request is parsed
+func validateHeaders(req *http.Request) error {
+	for _, header := range []string{"X-GitHub-Event", "X-GitHub-Delivery"} {
+		if req.Header.Get(header) == "" {
+			return fmt.Errorf("missing %s header", header)
+		}
+	}
+	return nil
 }
 
-// ManualTrigger manually triggers the ci job
-func ManualTrigger(repo, owner, sha, language, url string, updateBuildStatusFunc func(string)) {
+// Reporters is set by the app to set the status callbacks of the builds of webhook events
+// It's executed with the numbered job, the host the webhook was delivered to and the repo and commit built
+// Builds aren't reported while it's nil
+var Reporters func(job *ci.JobDetails, host, owner, repo, sha string)
+
+// LinkedPullRequest is set by the app to summarize builds on the pull requests linked to them
+// It's executed with the linked job, the host the webhook was delivered to, the repo and the pull request's number
+// when a pull request that wants a summary comment is linked to an existing build
+var LinkedPullRequest func(job *ci.JobDetails, host, owner, repo string, pr int64)
+
+// ManualTrigger manually triggers the ci job and returns the name of the new build
+// setReporters is given the numbered job to set its status callbacks on
+func ManualTrigger(repo, owner, sha, language, url string, setReporters func(*ci.JobDetails)) string {
 	job := &ci.JobDetails{
-		LogFileName:            fmt.Sprintf("%s/%s/%s", owner, repo, sha),
+		BuildKey:               fmt.Sprintf("%s/%s/%s", owner, repo, sha),
 		ProjectBranch:          sha,
 		ProjectRepositoryURL:   url,
 		ProjectLanguage:        language,
 		ProjectRespositoryName: repo,
-		UpdateBuildStatus:      updateBuildStatusFunc,
+		Trigger:                "manual",
 	}
+	ej := &eventJob{JobDetails: job, owner: owner, repo: repo, sha: sha}
+	job.Steps = ej.config().Statuses.Steps
+	job.SetReporters = setReporters
 
 	fmt.Println("Here's the job details: ", job)
 	ci.Run(job)
+	return job.LogFileName
+}
+
+// describe sets the details of the change shown in the project's build history
+func (job *eventJob) describe() {
+	job.Branch = job.branch
+	if msgs := job.commitMessages(); len(msgs) > 0 {
+		job.Message = strings.SplitN(strings.TrimSpace(msgs[0]), "\n", 2)[0]
+	}
 }
 
-func buildPushEventJob(payload []byte) (*ci.JobDetails, error) {
+func buildPushEventJob(payload []byte) (*eventJob, error) {
 	evt := github.PushPayload{}
 	if err := json.Unmarshal(payload, &evt); err != nil {
 		return nil, err
 	}
 
 	branch := evt.After
+	language, err := repoLanguage(evt.Repository.FullName, evt.Repository.Language)
+	if err != nil {
+		return nil, err
+	}
+
 	job := &ci.JobDetails{
-		LogFileName:            filepath.Join(evt.Repository.FullName, branch),
+		BuildKey:               filepath.Join(evt.Repository.FullName, branch),
 		ProjectBranch:          branch,
 		ProjectRepositoryURL:   evt.Repository.SSHURL,
-		ProjectLanguage:        *evt.Repository.Language,
+		ProjectLanguage:        language,
 		ProjectRespositoryName: evt.Repository.Name,
+		Trigger:                "push " + evt.Ref,
+		Author:                 evt.HeadCommit.Author.Username,
+		CoverageBase:           evt.Repository.DefaultBranch,
+	}
+	if job.Author == "" {
+		job.Author = evt.HeadCommit.Author.Name
 	}
-	return job, nil
+
+	files := []string{}
+	for _, commit := range evt.Commits {
+		files = append(files, commit.Added...)
+		files = append(files, commit.Removed...)
+		files = append(files, commit.Modified...)
+	}
+
+	ej := &eventJob{
+		JobDetails: job,
+		owner:      evt.Repository.Owner.Login,
+		repo:       evt.Repository.Name,
+		sha:        evt.After,
+		files:      files,
+		messages:   []string{evt.HeadCommit.Message},
+		deleted:    evt.Deleted,
+	}
+
+	// tags aren't branches; they're built apart from the branch builds of the same commit
+	// so their deploy steps aren't coalesced away
+	if strings.HasPrefix(evt.Ref, "refs/tags/") {
+		job.Tag = strings.TrimPrefix(evt.Ref, "refs/tags/")
+		if !ej.deleted && !ci.ValidTag(job.Tag) {
+			return nil, fmt.Errorf("tag %q isn't built; tags are limited to letters, digits and _ . + / -", job.Tag)
+		}
+		job.BuildKey = filepath.Join(evt.Repository.FullName, job.Tag)
+		job.Trigger = "tag " + job.Tag
+		if evt.HeadCommit.ID != "" {
+			ej.sha = evt.HeadCommit.ID
+		}
+	} else {
+		ej.branch = strings.TrimPrefix(evt.Ref, "refs/heads/")
+	}
+	return ej, nil
 }
 
-func buildPREventJob(payload []byte) (*ci.JobDetails, error) {
+func buildPREventJob(payload []byte) (*eventJob, error) {
 	evt := github.PullRequestPayload{}
 	if err := json.Unmarshal(payload, &evt); err != nil {
 		return nil, err
 	}
 
 	branch := evt.PullRequest.Head.Sha
+	language, err := repoLanguage(evt.Repository.FullName, evt.Repository.Language)
+	if err != nil {
+		return nil, err
+	}
+
 	job := &ci.JobDetails{
-		LogFileName:            filepath.Join(evt.Repository.FullName, branch),
+		BuildKey:               filepath.Join(evt.Repository.FullName, branch),
 		ProjectBranch:          branch,
 		ProjectRepositoryURL:   evt.Repository.SSHURL,
-		ProjectLanguage:        *evt.Repository.Language,
+		ProjectLanguage:        language,
 		ProjectRespositoryName: evt.Repository.Name,
+		Trigger:                fmt.Sprintf("pull_request #%d", evt.Number),
+		Author:                 evt.PullRequest.User.Login,
+		CoverageBase:           evt.PullRequest.Base.Ref,
+	}
+
+	// the branch filters apply to the branch the pull request would be merged into
+	ej := &eventJob{
+		JobDetails:  job,
+		owner:       evt.Repository.Owner.Login,
+		repo:        evt.Repository.Name,
+		sha:         evt.PullRequest.Head.Sha,
+		branch:      evt.PullRequest.Base.Ref,
+		action:      evt.Action,
+		pullRequest: evt.Number,
+		baseSHA:     evt.PullRequest.Base.Sha,
+		mergeable:   evt.PullRequest.Mergeable,
 	}
-	return job, nil
+	if evt.PullRequest.MergeCommitSha != nil {
+		ej.mergeSHA = *evt.PullRequest.MergeCommitSha
+	}
+	return ej, nil
 }
 
-func buildPingEventJob(payload []byte) (*ci.JobDetails, error) {
+func buildPingEventJob(payload []byte) (*eventJob, error) {
 	evt := github.WatchPayload{}
 	if err := json.Unmarshal(payload, &evt); err != nil {
 		return nil, err
 	}
 	branch := "master"
+	language, err := repoLanguage(evt.Repository.FullName, evt.Repository.Language)
+	if err != nil {
+		return nil, err
+	}
+
 	job := &ci.JobDetails{
-		LogFileName:            filepath.Join(evt.Repository.FullName, branch),
+		BuildKey:               filepath.Join(evt.Repository.FullName, branch),
 		ProjectBranch:          branch,
 		ProjectRepositoryURL:   evt.Repository.SSHURL,
-		ProjectLanguage:        *evt.Repository.Language,
+		ProjectLanguage:        language,
 		ProjectRespositoryName: evt.Repository.Name,
+		Trigger:                "ping",
+	}
+
+	ej := &eventJob{
+		JobDetails: job,
+		owner:      evt.Repository.Owner.Login,
+		repo:       evt.Repository.Name,
+		sha:        branch,
+		messages:   []string{},
+	}
+	return ej, nil
+}
+
+func repoLanguage(repo string, language *string) (string, error) {
+	if language == nil {
+		return "", fmt.Errorf("github hasn't detected a language for %s", repo)
 	}
-	return job, nil
+	return *language, nil
 }
@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/0sc/sicuro/ci"
+	githubhook "gopkg.in/rjz/githubhook.v0"
+)
+
+// deletePushPayload is the push event github sends when a ref is deleted
+func deletePushPayload(ref string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"ref": %q,
+		"before": "6113728f27ae82c7b1a177c8d03f9e96e0adf246",
+		"after": "0000000000000000000000000000000000000000",
+		"deleted": true,
+		"commits": [],
+		"head_commit": null,
+		"repository": {
+			"name": "hello",
+			"full_name": "octocat/hello",
+			"language": "Ruby",
+			"ssh_url": "git@github.com:octocat/hello.git",
+			"default_branch": "master",
+			"owner": {"login": "octocat"}
+		}
+	}`, ref))
+}
+
+func TestPushEventDeletes(t *testing.T) {
+	cases := []struct {
+		ref    string
+		tag    string
+		branch string
+		reason string
+	}{
+		{"refs/tags/v1.0.0", "v1.0.0", "", "tag v1.0.0 deleted"},
+		{"refs/heads/feature/login", "", "feature/login", "branch feature/login deleted; cancelled 0 builds"},
+	}
+
+	for _, c := range cases {
+		job, err := buildPushEventJob(deletePushPayload(c.ref))
+		if err != nil {
+			t.Fatalf("buildPushEventJob(%s) returned %s", c.ref, err)
+		}
+		if !job.deleted || job.Tag != c.tag || job.branch != c.branch {
+			t.Errorf("buildPushEventJob(%s) = deleted %t, tag %q, branch %q; want deleted, tag %q, branch %q",
+				c.ref, job.deleted, job.Tag, job.branch, c.tag, c.branch)
+		}
+
+		d := &Delivery{ID: "delete " + c.ref, Event: "push"}
+		process(d, &githubhook.Hook{Event: "push", Payload: deletePushPayload(c.ref)})
+		if d.Outcome != OutcomeIgnored || d.Error != c.reason || d.Build != "" {
+			t.Errorf("delete of %s got outcome %s (%s) building %q; want it ignored with %q", c.ref, d.Outcome, d.Error, d.Build, c.reason)
+		}
+	}
+}
+
+// prPayload is the pull request event github sends for pull request #7 of octocat/hello into master at base
+func prPayload(base, mergeable string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"action": "synchronize",
+		"number": 7,
+		"pull_request": {
+			"merge_commit_sha": "e5bd3914e2e596debea16f433f57875b5b90bcd6",
+			"mergeable": %s,
+			"user": {"login": "octocat"},
+			"head": {"ref": "feature", "sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e"},
+			"base": {"ref": "master", "sha": %q}
+		},
+		"repository": {
+			"name": "hello",
+			"full_name": "octocat/hello",
+			"language": "Ruby",
+			"ssh_url": "git@github.com:octocat/hello.git",
+			"default_branch": "master",
+			"owner": {"login": "octocat"}
+		}
+	}`, mergeable, base))
+}
+
+func TestPREventMergeRef(t *testing.T) {
+	cases := []struct {
+		base      string
+		mergeable string
+		key       string
+		skip      string
+	}{
+		{"a1b2c3", "true", "octocat/hello/6dcb09b5b57875f334f61aebed695e2e4193db5e-merge-a1b2c3", ""},
+		// the same head merged into a newer base is another build
+		{"d4e5f6", "true", "octocat/hello/6dcb09b5b57875f334f61aebed695e2e4193db5e-merge-d4e5f6", ""},
+		// github hasn't checked whether it merges yet
+		{"a1b2c3", "null", "octocat/hello/6dcb09b5b57875f334f61aebed695e2e4193db5e-merge-a1b2c3", ""},
+		{"a1b2c3", "false", "octocat/hello/6dcb09b5b57875f334f61aebed695e2e4193db5e-merge-a1b2c3",
+			"pull request #7 has conflicts with master so there's no merge to build"},
+	}
+
+	for _, c := range cases {
+		job, err := buildPREventJob(prPayload(c.base, c.mergeable))
+		if err != nil {
+			t.Fatalf("buildPREventJob(base %s) returned %s", c.base, err)
+		}
+		job.useMergeRef()
+		if job.BuildKey != c.key || job.ProjectRef != "refs/pull/7/merge" {
+			t.Errorf("merge of base %s got key %q ref %q; want key %q ref refs/pull/7/merge", c.base, job.BuildKey, job.ProjectRef, c.key)
+		}
+		if skip := job.skipReason(&ci.Config{}); skip != c.skip {
+			t.Errorf("merge of base %s mergeable %s got skip reason %q; want %q", c.base, c.mergeable, skip, c.skip)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package webhook
+
+import (
+	"os"
+	"testing"
+
+	"github.com/0sc/sicuro/store/storetest"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(storetest.Main(m))
+}
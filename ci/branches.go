@@ -0,0 +1,61 @@
+package ci
+
+import (
+	"log"
+	"time"
+
+	"github.com/0sc/sicuro/store"
+)
+
+var branches = store.New("branches")
+
+// Branch is the record of a project's branch that has been deleted
+type Branch struct {
+	// Project is of the form owner/repo
+	Project    string
+	Name       string
+	Archived   bool
+	ArchivedAt time.Time
+}
+
+func branchKey(project, name string) string {
+	return project + "#" + name
+}
+
+// ArchiveBranch marks the project's branch as deleted
+// Its builds are kept in the project's history
+func ArchiveBranch(project, name string) {
+	b := Branch{Project: project, Name: name, Archived: true, ArchivedAt: time.Now()}
+	if err := branches.Put(branchKey(project, name), b); err != nil {
+		log.Printf("Error: %s occurred while archiving branch %s of %s\n", err, name, project)
+	}
+}
+
+// RestoreBranch unmarks the project's branch as deleted e.g when a branch with the same name is created
+func RestoreBranch(project, name string) {
+	if err := branches.Delete(branchKey(project, name)); err != nil {
+		log.Printf("Error: %s occurred while restoring branch %s of %s\n", err, name, project)
+	}
+}
+
+// ArchivedBranches returns the project's deleted branches
+func ArchivedBranches(project string) []Branch {
+	archived := []Branch{}
+	keys, err := branches.Keys()
+	if err != nil {
+		log.Println("Error occurred while listing branches: ", err)
+		return archived
+	}
+
+	for _, key := range keys {
+		b := Branch{}
+		if _, err := branches.Get(key, &b); err != nil {
+			log.Printf("Error: %s occurred while reading branch %s\n", err, key)
+			continue
+		}
+		if b.Project == project && b.Archived {
+			archived = append(archived, b)
+		}
+	}
+	return archived
+}
@@ -0,0 +1,389 @@
+package ci
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0sc/sicuro/store"
+)
+
+const (
+	// StatusQueued is the status of a build that's been accepted but not yet started
+	StatusQueued = "queued"
+	// StatusPending is the status of a running build
+	StatusPending = "pending"
+	// StatusSuccess is the status of a build whose tests passed
+	StatusSuccess = "success"
+	// StatusFailure is the status of a build whose tests failed
+	StatusFailure = "failure"
+	// StatusError is the status of a build that couldn't run
+	StatusError = "error"
+	// StatusSkipped is the status of a build that wasn't run e.g because of the project's branch filters
+	StatusSkipped = "skipped"
+	// StatusCancelled is the status of a build that was stopped before it finished
+	StatusCancelled = "cancelled"
+)
+
+var (
+	builds = store.New("builds")
+	// buildNumbers holds the number of the latest build of each project keyed by owner/repo
+	buildNumbers = store.New("build_numbers")
+	// numberMu serializes handing out build numbers
+	numberMu sync.Mutex
+	// queueMu serializes checking for an existing build and queueing a new one
+	queueMu sync.Mutex
+	// recordMu serializes updates to build records
+	recordMu sync.Mutex
+)
+
+// Build is the record of a run of a job
+type Build struct {
+	// Name is the job's LogFileName e.g owner/repo/builds/42
+	Name string
+	// Number is the build's position in the project's sequence of builds
+	Number int
+	// Key is the job's BuildKey; builds with the same key tested the same thing
+	Key string
+	// Commit is the commit hash, branch or tag that was checked out
+	Commit string
+	// Branch, Author and Message describe the change built; see JobDetails
+	Branch     string
+	Author     string
+	Message    string
+	Status     string
+	QueuedAt   time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Triggers are the events that asked for the build e.g a push and a pull request for the same commit
+	Triggers []string
+	// Reason explains why the build was skipped
+	Reason string
+	// Notice is the job's Notice
+	Notice string
+	// Ref is the ref tested in place of the commit e.g refs/pull/12/merge
+	Ref string
+	// MergeSHA is the sha of the merge commit tested when Ref is a pull request merge ref
+	MergeSHA string
+	// Tag is the tag the build is for, if any
+	Tag string
+	// Deploy is true if the build runs the project's deploy steps
+	Deploy bool
+	// Steps are the outcomes of the build's steps e.g setup and test once it's finished
+	Steps []StepResult
+	// Coverage is the percentage of lines covered by the tests, if the build reported it
+	Coverage *float64
+}
+
+// Finished returns true once the build has a final status
+func (b *Build) Finished() bool {
+	switch b.Status {
+	case StatusSuccess, StatusFailure, StatusError, StatusSkipped, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// Duration returns how long the build has been running or ran for
+// It's zero until the build starts
+func (b *Build) Duration() time.Duration {
+	if b.StartedAt.IsZero() {
+		return 0
+	}
+	end := b.FinishedAt
+	if end.IsZero() || end.Before(b.StartedAt) {
+		end = time.Now()
+	}
+	return end.Sub(b.StartedAt).Round(time.Second)
+}
+
+// BuildFilter narrows down the builds listed by ProjectBuilds
+// Empty fields match every build
+type BuildFilter struct {
+	Branch string
+	Status string
+}
+
+func (f BuildFilter) matches(b *Build) bool {
+	return (f.Branch == "" || f.Branch == b.Branch) && (f.Status == "" || f.Status == b.Status)
+}
+
+// ProjectBuilds returns the builds of the project matching the filter, most recent first
+// project is of the form owner/repo
+func ProjectBuilds(project string, filter BuildFilter) []*Build {
+	found := []*Build{}
+	names, err := builds.Keys()
+	if err != nil {
+		log.Println("Error occurred while listing builds: ", err)
+		return found
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, project+"/") {
+			continue
+		}
+		b := &Build{}
+		if _, err := builds.Get(name, b); err != nil {
+			log.Printf("Error: %s occurred while reading build %s\n", err, name)
+			continue
+		}
+		if filter.matches(b) {
+			found = append(found, b)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Number != found[j].Number {
+			return found[i].Number > found[j].Number
+		}
+		return found[i].QueuedAt.After(found[j].QueuedAt)
+	})
+	return found
+}
+
+// PullRequests returns the numbers of the pull requests linked to the build
+func (b *Build) PullRequests() []int64 {
+	prs := []int64{}
+	for _, t := range b.Triggers {
+		var n int64
+		if _, err := fmt.Sscanf(t, "pull_request #%d", &n); err == nil {
+			prs = append(prs, n)
+		}
+	}
+	return prs
+}
+
+// BaseCoverage returns the coverage of the latest successful build of a push to the project's branch
+// It returns false if that build didn't report coverage or there's no such build
+func BaseCoverage(project, branch string) (float64, bool) {
+	b := latestPushBuild(project, branch, StatusSuccess)
+	if b == nil || b.Coverage == nil {
+		return 0, false
+	}
+	return *b.Coverage, true
+}
+
+// LatestBranchResult returns the latest build of a push to the project's branch that produced a result
+// i.e succeeded, failed or errored. Pull request builds merging into the branch aren't considered
+// It returns nil if there's no such build
+func LatestBranchResult(project, branch string) *Build {
+	return latestPushBuild(project, branch, StatusSuccess, StatusFailure, StatusError)
+}
+
+// latestPushBuild returns the most recent build of a push to the project's branch with one of the statuses
+// which must be final statuses. It returns nil if there's no such build
+func latestPushBuild(project, branch string, statuses ...string) *Build {
+	latest := indexEntry{}
+	for status, entry := range projectIndex(project).Pushes[branch] {
+		if hasStatus(&Build{Status: status}, statuses) && entry.Number > latest.Number {
+			latest = entry
+		}
+	}
+	if latest.Name == "" {
+		return nil
+	}
+	return FindBuild(latest.Name)
+}
+
+func hasStatus(b *Build, statuses []string) bool {
+	for _, status := range statuses {
+		if b.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// FindBuild returns the record of the build with the given name
+// It returns nil if there's no record of the build
+func FindBuild(name string) *Build {
+	b := &Build{}
+	found, err := builds.Get(name, b)
+	if err != nil {
+		log.Printf("Error: %s occurred while fetching build %s\n", err, name)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	return b
+}
+
+// NumberBuild assigns the job the project's next build number and the log file name matching it
+// then sets its reporters
+func NumberBuild(job *JobDetails) {
+	numberMu.Lock()
+	defer numberMu.Unlock()
+
+	project := job.project()
+	n := 0
+	if _, err := buildNumbers.Get(project, &n); err != nil {
+		log.Printf("Error: %s occurred while fetching the build number of %s\n", err, project)
+	}
+	n++
+	if err := buildNumbers.Put(project, n); err != nil {
+		log.Printf("Error: %s occurred while saving the build number of %s\n", err, project)
+	}
+
+	job.Number = n
+	job.LogFileName = fmt.Sprintf("%s/builds/%d", project, n)
+	if job.SetReporters != nil {
+		job.SetReporters(job)
+	}
+}
+
+// latestBuild returns the most recent build with the given key
+// It returns nil if nothing has been built for the key
+func latestBuild(key string) *Build {
+	entry, ok := projectIndex(projectOf(key)).Keys[key]
+	if !ok {
+		return nil
+	}
+	return FindBuild(entry.Name)
+}
+
+// Rerunnable returns true if the build didn't produce a test result
+// i.e it errored, was skipped or was cancelled
+func (b *Build) Rerunnable() bool {
+	switch b.Status {
+	case StatusError, StatusSkipped, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// RunOrLink runs the job unless a build with the same key has already been queued, is running or has
+// finished with a test result; in that case the job's trigger is linked to the existing build instead
+// and the job takes on the build's name. It returns true if the job was linked to an existing build
+func RunOrLink(job *JobDetails) bool {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	b := latestBuild(job.BuildKey)
+	if b == nil || b.Rerunnable() {
+		Run(job)
+		return false
+	}
+
+	job.Number = b.Number
+	job.LogFileName = b.Name
+	if job.Trigger != "" {
+		linkTrigger(b.Name, job.Trigger)
+	}
+	return true
+}
+
+// Skip records that the job won't be run and why, in place of running it
+// The skip is only reported through the job's UpdateBuildStatus callback when report is true
+// A skip never replaces an existing build of the same key; otherwise it's numbered like a build
+func Skip(job *JobDetails, reason string, report bool) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if b := latestBuild(job.BuildKey); b != nil && !b.Rerunnable() {
+		log.Printf("Not skipping %s; it has already been built as %s\n", job.BuildKey, b.Name)
+		job.Number = b.Number
+		job.LogFileName = b.Name
+		return
+	}
+
+	NumberBuild(job)
+	job.logFilePath = filepath.Join(LogDIR, job.LogFileName+LogFileExt)
+	if err := createDirFor(job.logFilePath); err != nil {
+		log.Println("Couldn't create directory for job: ", err)
+		return
+	}
+	msg := fmt.Sprintf("<h4>Build skipped: %s</h4>", html.EscapeString(reason))
+	if err := ioutil.WriteFile(job.logFilePath, []byte(msg), 0755); err != nil {
+		log.Printf("Error: %s occurred while writing logfile %s\n", err, job.logFilePath)
+	}
+
+	job.skipReason = reason
+	if report {
+		job.updateBuildStatus(StatusSkipped)
+	} else {
+		job.recordStatus(StatusSkipped)
+	}
+}
+
+func linkTrigger(name, trigger string) {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+
+	b := FindBuild(name)
+	if b == nil || hasTrigger(b, trigger) {
+		return
+	}
+
+	b.Triggers = append(b.Triggers, trigger)
+	if err := builds.Put(b.Name, b); err != nil {
+		log.Printf("Error: %s occurred while linking %s to build %s\n", err, trigger, b.Name)
+		return
+	}
+	indexBuild(b)
+}
+
+func hasTrigger(b *Build, trigger string) bool {
+	for _, t := range b.Triggers {
+		if t == trigger {
+			return true
+		}
+	}
+	return false
+}
+
+func (job *JobDetails) recordStatus(status string) {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+
+	b := FindBuild(job.LogFileName)
+	if b == nil || status == StatusQueued || status == StatusSkipped {
+		b = &Build{
+			Name:    job.LogFileName,
+			Number:  job.Number,
+			Key:     job.BuildKey,
+			Commit:  job.ProjectBranch,
+			Branch:  job.Branch,
+			Author:  job.Author,
+			Message: job.Message,
+		}
+		if job.Trigger != "" {
+			b.Triggers = []string{job.Trigger}
+		}
+	}
+
+	now := time.Now()
+	b.Status = status
+	b.Reason = job.skipReason
+	b.Notice = job.Notice
+	b.Ref = job.ProjectRef
+	b.MergeSHA = job.MergeSHA
+	b.Tag = job.Tag
+	b.Deploy = job.Deploy
+	if job.steps != nil {
+		b.Steps = job.steps
+	}
+	if job.coverage != nil {
+		b.Coverage = job.coverage
+	}
+	switch status {
+	case StatusQueued:
+		b.QueuedAt = now
+	case StatusPending:
+		b.StartedAt = now
+	default:
+		b.FinishedAt = now
+	}
+
+	if err := builds.Put(b.Name, b); err != nil {
+		log.Printf("Error: %s occurred while recording status %s for build %s\n", err, status, b.Name)
+		return
+	}
+	indexBuild(b)
+}
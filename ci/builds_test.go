@@ -0,0 +1,77 @@
+package ci
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLatestBranchResult(t *testing.T) {
+	coverage := 80.0
+	records := []*Build{
+		{Name: "octocat/badge/builds/1", Number: 1, Branch: "master", Status: StatusFailure, Triggers: []string{"push refs/heads/master"}},
+		{Name: "octocat/badge/builds/2", Number: 2, Branch: "master", Status: StatusSuccess, Triggers: []string{"push refs/heads/master"}, Coverage: &coverage},
+		// a pull request merging into master
+		{Name: "octocat/badge/builds/3", Number: 3, Branch: "master", Status: StatusFailure, Triggers: []string{"pull_request #7"}},
+		{Name: "octocat/badge/builds/4", Number: 4, Branch: "master", Status: StatusCancelled, Triggers: []string{"push refs/heads/master"}},
+		{Name: "octocat/badge/builds/5", Number: 5, Branch: "feature", Status: StatusError, Triggers: []string{"push refs/heads/feature"}},
+		// another project whose name shares the prefix
+		{Name: "octocat/badger/builds/9", Number: 9, Branch: "master", Status: StatusFailure, Triggers: []string{"push refs/heads/master"}},
+	}
+	for _, b := range records {
+		if err := builds.Put(b.Name, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if b := LatestBranchResult("octocat/badge", "master"); b == nil || b.Number != 2 {
+		t.Errorf("LatestBranchResult(master) = %+v; want build 2", b)
+	}
+	if b := LatestBranchResult("octocat/badge", "feature"); b == nil || b.Number != 5 {
+		t.Errorf("LatestBranchResult(feature) = %+v; want build 5", b)
+	}
+	if b := LatestBranchResult("octocat/badge", "develop"); b != nil {
+		t.Errorf("LatestBranchResult(develop) = %+v; want nil", b)
+	}
+	if got, ok := BaseCoverage("octocat/badge", "master"); !ok || got != coverage {
+		t.Errorf("BaseCoverage(master) = %v, %t; want %v", got, ok, coverage)
+	}
+}
+
+func TestBuildIndex(t *testing.T) {
+	record := func(n int, key, trigger, status string) {
+		job := &JobDetails{BuildKey: key, Number: n, LogFileName: fmt.Sprintf("octocat/index/builds/%d", n), Trigger: trigger}
+		job.recordStatus(StatusQueued)
+		if status != StatusQueued {
+			job.recordStatus(status)
+		}
+	}
+	record(1, "octocat/index/abc", "push refs/heads/master", StatusSuccess)
+	record(2, "octocat/index/abc", "push refs/heads/master", StatusFailure)
+	record(3, "octocat/index/def", "push refs/heads/master", StatusQueued)
+	record(4, "octocat/index/abc-merge-123", "pull_request #7", StatusSuccess)
+
+	if b := latestBuild("octocat/index/abc"); b == nil || b.Number != 2 {
+		t.Errorf("latestBuild(abc) = %+v; want build 2", b)
+	}
+	if b := latestBuild("octocat/index/def"); b == nil || b.Status != StatusQueued {
+		t.Errorf("latestBuild(def) = %+v; want queued build 3", b)
+	}
+	if b := latestBuild("octocat/index/ghi"); b != nil {
+		t.Errorf("latestBuild(ghi) = %+v; want nil", b)
+	}
+	// the running build 3 has no result yet
+	if b := LatestBranchResult("octocat/index", "master"); b == nil || b.Number != 2 {
+		t.Errorf("LatestBranchResult(master) = %+v; want build 2", b)
+	}
+
+	// a push linked to a finished build counts as a build of the branch
+	linkTrigger("octocat/index/builds/4", "push refs/heads/release")
+	if b := LatestBranchResult("octocat/index", "release"); b == nil || b.Number != 4 {
+		t.Errorf("LatestBranchResult(release) = %+v; want build 4", b)
+	}
+
+	removeProjectRecords("octocat/index")
+	if b := latestBuild("octocat/index/abc"); b != nil {
+		t.Errorf("latestBuild(abc) = %+v after the project was removed; want nil", b)
+	}
+}
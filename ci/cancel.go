@@ -0,0 +1,164 @@
+package ci
+
+import (
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// killInterval is how often a cancelled job's container is looked for to be killed
+	killInterval = time.Second
+
+	// activeJobs are the queued and running jobs keyed by LogFileName
+	activeJobs = map[string]*JobDetails{}
+	activeMu   sync.Mutex
+)
+
+func (job *JobDetails) activate() {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	activeJobs[job.LogFileName] = job
+}
+
+func (job *JobDetails) deactivate() {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if activeJobs[job.LogFileName] == job {
+		delete(activeJobs, job.LogFileName)
+	}
+}
+
+// start records the container the job runs in
+// It returns false if the job was cancelled before it started
+func (job *JobDetails) start(container string) bool {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	job.container = container
+	return !job.cancelled
+}
+
+func (job *JobDetails) isCancelled() bool {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	return job.cancelled
+}
+
+// cancel marks the job cancelled; a job that hasn't started never runs and
+// the container of a running job is killed by killWhenCancelled. The caller must hold activeMu
+func (job *JobDetails) cancel() {
+	job.cancelled = true
+}
+
+// killWhenCancelled kills the job's container once the job is cancelled, until done is closed
+// The container may not exist yet when the cancel arrives so failed kills are retried
+// The returned channel gets whether the container was killed once done is closed or the kill succeeds
+func (job *JobDetails) killWhenCancelled(done <-chan struct{}) <-chan bool {
+	killed := make(chan bool, 1)
+	go func() {
+		ticker := time.NewTicker(killInterval)
+		defer ticker.Stop()
+
+		var err error
+		for {
+			select {
+			case <-done:
+				if err != nil {
+					log.Printf("Error: %s occurred while killing container %s of build %s\n", err, job.container, job.LogFileName)
+				}
+				killed <- false
+				return
+			case <-ticker.C:
+			}
+
+			if !job.isCancelled() {
+				continue
+			}
+			if err = exec.Command("docker", "kill", job.container).Run(); err == nil {
+				killed <- true
+				return
+			}
+		}
+	}()
+	return killed
+}
+
+// Cancel stops the queued or running build with the given name
+// It returns false if there's no such build
+func Cancel(name string) bool {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	job, ok := activeJobs[name]
+	if ok {
+		job.cancel()
+	}
+	return ok
+}
+
+// CancelTriggered stops the project's queued and running builds that were only asked for by the given trigger
+// e.g the builds of a pull request that's been closed. Builds also linked to other triggers keep running
+// project is of the form owner/repo. It returns the names of the cancelled builds
+func CancelTriggered(project, trigger string) []string {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	cancelled := []string{}
+	for name, job := range activeJobs {
+		if !strings.HasPrefix(name, project+"/") {
+			continue
+		}
+
+		b := FindBuild(name)
+		if b == nil || len(b.Triggers) != 1 || b.Triggers[0] != trigger {
+			continue
+		}
+
+		job.cancel()
+		cancelled = append(cancelled, name)
+	}
+	return cancelled
+}
+
+// CancelSuperseded stops the project's queued and running builds for the same branch or pull request as the job
+// i.e those linked to the job's trigger, other than the job's own build. It returns the names of the cancelled builds
+func CancelSuperseded(job *JobDetails) []string {
+	project := job.project()
+
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	cancelled := []string{}
+	for name, active := range activeJobs {
+		if name == job.LogFileName || !strings.HasPrefix(name, project+"/") {
+			continue
+		}
+
+		b := FindBuild(name)
+		if b == nil || !hasTrigger(b, job.Trigger) {
+			continue
+		}
+
+		active.cancel()
+		cancelled = append(cancelled, name)
+	}
+	return cancelled
+}
+
+// CancelProject stops all the project's queued and running builds e.g when it's unsubscribed
+// project is of the form owner/repo. It returns the names of the cancelled builds
+func CancelProject(project string) []string {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	cancelled := []string{}
+	for name, job := range activeJobs {
+		if strings.HasPrefix(name, project+"/") {
+			job.cancel()
+			cancelled = append(cancelled, name)
+		}
+	}
+	return cancelled
+}
@@ -2,10 +2,12 @@ package ci
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/kjk/betterguid"
@@ -17,36 +19,94 @@ const (
 )
 
 var (
+	invalidVolumeChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+	// tagChars are the characters allowed in the tags that are built
+	// It's stricter than git so tags are safe to use in paths, log files and deploy commands
+	tagChars = regexp.MustCompile(`^[a-zA-Z0-9_.+/-]+$`)
+	// mergeSHAMarker matches the line the test container logs with the sha of a checked out merge ref
+	mergeSHAMarker = regexp.MustCompile(`<!-- sicuro:merge-sha ([0-9a-f]{40}) -->`)
 	// ciDIR is the absolute path to the CI directory
 	ciDIR = filepath.Join(os.Getenv("ROOT_DIR"), "ci")
 	// LogDIR is the absolute path to the CI log directory
 	LogDIR = filepath.Join(ciDIR, "logs")
 	// List of supported languages
 	// and the available docker image version
+	// The images are built from dockerfiles/build.yml; the server relies on the markers their entrypoints log
+	// so the tag must be bumped there and here whenever an entrypoint changes
 	availableImages = map[string]string{
-		"ruby":       "xovox/sicuro_ruby:0.2",
-		"javascript": "xovox/sicuro_javascript:0.2",
+		"ruby":       "xovox/sicuro_ruby:0.4",
+		"javascript": "xovox/sicuro_javascript:0.4",
 	}
 )
 
 // JobDetails contains necessary information required to run tests for a given project
 type JobDetails struct {
-	// LogFileName is the name to be used for the test output log.
-	// It should always be the commit hash e.g 5eace776ec66a70b2775f4bbb9e2b2847331b0a9
-	// or branch name e.g master
+	// BuildKey identifies what's built e.g owner/repo/<commit hash> or owner/repo/<tag>
+	// It must start with the project's owner/repo. A job is linked to the latest build
+	// with the same key instead of being built again, unless that build is rerunnable
+	BuildKey string
+	// LogFileName is the name of the build and its test output log e.g owner/repo/builds/42
+	// It's assigned when the build is numbered; see NumberBuild
 	LogFileName string
+	// Number is the build's position in the project's sequence of builds
+	Number      int
 	logFilePath string
+	skipReason  string
+	// container is the name of the docker container running the job
+	container string
+	cancelled bool
 	// ProjectRespositoryName is the name of the project's repository on the VCS
 	// It's used when cloning the project in test container
 	ProjectRespositoryName string
 	// ProjectBranch is the target branch to run the tests on
 	// It could also be a commit hash if the target is a particular commit
 	ProjectBranch string
+	// ProjectRef is a ref fetched and tested in place of ProjectBranch if set
+	// e.g refs/pull/12/merge to test the result of merging a pull request
+	ProjectRef string
+	// MergeSHA is the sha of the merge commit tested when ProjectRef is a pull request merge ref
+	// It's updated with the sha actually checked out once the build runs
+	MergeSHA string
 	// ProjectRespositoryURL is the SSH url for pull the code from the VCS
 	ProjectRepositoryURL string
 	// ProjectLanguage is the programming language the project is written in
 	// This would be used to determine the docker image for running the tests
 	ProjectLanguage string
+	// Branch is the branch the job is for, if any; for pull requests it's the branch being merged into
+	Branch string
+	// Author is the VCS login or name of whoever authored the change being built
+	Author string
+	// Message is the first line of the commit message of the change being built
+	Message string
+	// Trigger describes the event that asked for the job e.g push refs/heads/master or pull_request #12
+	Trigger string
+	// RebuildCache clears the project's dependency cache before the tests are run
+	RebuildCache bool
+	// Tag is the name of the tag being built, if the build is for a tag
+	// It's exposed to the build as SICURO_TAG
+	Tag string
+	// Deploy runs the deploy section of the project's sicuro.json after the tests pass
+	Deploy bool
+	// Steps lists the build steps e.g test or lint reported under their own status through UpdateStepStatus
+	Steps []string
+	// steps are the outcomes of the build's steps read from its log once it's finished
+	steps []StepResult
+	// coverage is the percentage of lines covered by the tests read from the log once the build's finished
+	coverage *float64
+	// UpdateStepStatus is a callback function executed with the status of each of the Steps
+	// They're all reported pending once the tests start and again with their result at test completion
+	UpdateStepStatus func(step, status string)
+	// SummaryComment keeps a comment summarising the build up to date on the pull requests it's linked to
+	SummaryComment bool
+	// CoverageBase is the branch whose coverage the build's coverage is compared with in the summary comment
+	// i.e the pull request's base branch or the repo's default branch
+	CoverageBase string
+	// Notice is shown with the build e.g to tell the project's owner its statuses can't be reported
+	// It's set by SetReporters
+	Notice string
+	// SetReporters is executed with the job once it's numbered, to set its status callbacks
+	// which need the name of the build
+	SetReporters func(*JobDetails)
 	// UpdateBuildStatus is a callback function that would be executed with updates of the test
 	// It would be executed with the build status pending, failure, success as argument
 	// Once the tests starts, it's executed with the pending status argument
@@ -60,10 +120,14 @@ func init() {
 }
 
 // Run triggers the CI server for the given job
+// It numbers the job if it hasn't been, so every run gets its own log
 // It builds the absolute path to the job log file, creating necessary parent directories
 // It terminates if a routine is currently active for the given job
 // Otherwise, sets up a new routine for the job
 func Run(job *JobDetails) {
+	if job.LogFileName == "" {
+		NumberBuild(job)
+	}
 	job.logFilePath = filepath.Join(LogDIR, fmt.Sprintf("%s%s", job.LogFileName, LogFileExt))
 	err := createDirFor(job.logFilePath)
 	if err != nil {
@@ -78,7 +142,7 @@ func Run(job *JobDetails) {
 	}
 
 	// prepare log file i.e clear file content or create new file
-	if err := exec.Command("bash", "-c", "> "+job.logFilePath).Run(); err != nil {
+	if err := ioutil.WriteFile(job.logFilePath, nil, 0755); err != nil {
 		log.Printf("Error: %s occurred while trying to clear logfile %s\n", err, job.logFilePath)
 		return
 	}
@@ -86,9 +150,14 @@ func Run(job *JobDetails) {
 	job.ProjectLanguage = strings.ToLower(job.ProjectLanguage)
 	if !supportedLanguage(job.ProjectLanguage) {
 		log.Println("Project Language is currently not supported")
+		msg := fmt.Sprintf("<h4>Projects written in %q are currently not supported</h4>", job.ProjectLanguage)
+		ioutil.WriteFile(job.logFilePath, []byte(msg), 0755)
+		job.updateBuildStatus(StatusError)
 		return
 	}
 
+	job.recordStatus(StatusQueued)
+	job.activate()
 	log.Printf("Running job: %v\n", job)
 	go runCI(job)
 }
@@ -100,36 +169,76 @@ func createDirFor(fileName string) error {
 }
 
 func runCI(job *JobDetails) {
+	defer job.deactivate()
+
 	logFile, err := os.OpenFile(job.logFilePath, os.O_RDWR|os.O_CREATE, 0755)
 	if err != nil {
 		log.Printf("Error %s occurred while opening log file: %s\n", err, job.logFilePath)
-		job.updateBuildStatus("error")
+		job.updateBuildStatus(StatusError)
 		return
 	}
 
 	defer logFile.Close()
-	job.updateBuildStatus("pending")
+
+	container := "sicuro_" + betterguid.New()
+	if !job.start(container) {
+		job.updateBuildStatus(StatusCancelled)
+		logFile.WriteString("<h4>Build cancelled before it started</h4>")
+		return
+	}
+	job.updateBuildStatus(StatusPending)
+	job.reportSteps(StatusPending)
 
 	containerImg := availableImages[job.ProjectLanguage]
-	cmd := exec.Command("bash", "-c", fmt.Sprintf("%s '%s' %s", filepath.Join(ciDIR, "run.sh"), prepareEnvVars(job), containerImg))
+	// the job's details come from webhook payloads so they're passed as arguments, never through a shell
+	args := append([]string{containerImg, cacheVolume(job), container}, prepareEnvVars(job)...)
+	cmd := exec.Command(filepath.Join(ciDIR, "run.sh"), args...)
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
+	done := make(chan struct{})
+	killed := job.killWhenCancelled(done)
 	err = cmd.Run()
+	close(done)
 
 	msg := "Test completed successfully"
-	status := "success"
+	status := StatusSuccess
 	log.Println("Exit code: ", err)
-	if err != nil {
+	// a build cancelled too late to kill its container ran to the end and is recorded as it ended
+	if <-killed {
+		msg = "Build cancelled"
+		status = StatusCancelled
+	} else if err != nil {
 		msg = fmt.Sprintf("Test failed with exit code: %s", err)
-		status = "failure"
+		status = StatusFailure
 	}
 
+	if job.ProjectRef != "" {
+		job.readMergeSHA()
+	}
+	job.readResults(status)
 	job.updateBuildStatus(status)
+	job.reportSteps(status)
 	logFile.WriteString(fmt.Sprintf("<h4>%s</h4>", msg))
-	logFile.WriteString(fmt.Sprintf("<p><a href='/run?repo=%s'>Rebuild</a><p>", job.LogFileName))
+	// a manual rebuild only knows how to build a branch or commit
+	if job.ProjectRef == "" {
+		logFile.WriteString(fmt.Sprintf("<p><a href='/run?repo=%s'>Rebuild</a><p>", job.BuildKey))
+	}
+}
+
+// readMergeSHA picks the sha of the merge commit that was tested from the job's log
+func (job *JobDetails) readMergeSHA() {
+	data, err := ioutil.ReadFile(job.logFilePath)
+	if err != nil {
+		log.Printf("Error: %s occurred while reading logfile %s\n", err, job.logFilePath)
+		return
+	}
+	if match := mergeSHAMarker.FindSubmatch(data); match != nil {
+		job.MergeSHA = string(match[1])
+	}
 }
 
 func (job *JobDetails) updateBuildStatus(status string) {
+	job.recordStatus(status)
 	if job.UpdateBuildStatus != nil {
 		job.UpdateBuildStatus(status)
 	}
@@ -147,12 +256,59 @@ func ActiveCISession(logFile string) bool {
 	return cmd.Run() == nil
 }
 
-func prepareEnvVars(job *JobDetails) (vars string) {
-	vars = fmt.Sprintf("%s -e %s=%s", vars, "PROJECT_BRANCH", job.ProjectBranch)
-	vars = fmt.Sprintf("%s -e %s=%s", vars, "PROJECT_REPOSITORY_URL", job.ProjectRepositoryURL)
-	vars = fmt.Sprintf("%s -e %s=%s", vars, "PROJECT_REPOSITORY_NAME", job.ProjectRespositoryName)
-	vars = fmt.Sprintf("%s -e %s=%s", vars, "PROJECT_LANGUAGE", job.ProjectLanguage)
-	vars = fmt.Sprintf("%s -e %s=%s", vars, "DATABASE_URL", "postgres://postgres@postgres:5432/"+betterguid.New())
+// prepareEnvVars returns the docker run arguments setting the job's environment variables in the container
+// e.g -e PROJECT_BRANCH=master; each variable is its own argument whatever its value
+func prepareEnvVars(job *JobDetails) (args []string) {
+	env := func(name, value string) {
+		args = append(args, "-e", name+"="+value)
+	}
+
+	env("PROJECT_BRANCH", job.ProjectBranch)
+	if job.ProjectRef != "" {
+		env("PROJECT_REF", job.ProjectRef)
+	}
+	env("PROJECT_REPOSITORY_URL", job.ProjectRepositoryURL)
+	env("PROJECT_REPOSITORY_NAME", job.ProjectRespositoryName)
+	env("PROJECT_LANGUAGE", job.ProjectLanguage)
+	env("DATABASE_URL", "postgres://postgres@postgres:5432/"+betterguid.New())
+	if job.Tag != "" {
+		env("SICURO_TAG", job.Tag)
+	}
+	if job.Deploy {
+		env("SICURO_DEPLOY", "true")
+	}
+	if job.RebuildCache {
+		env("SICURO_REBUILD_CACHE", "true")
+	}
 
 	return
 }
+
+// ValidTag returns true if the tag is a valid git ref name, as git check-ref-format decides,
+// made up only of letters, digits and _ . + / -
+func ValidTag(tag string) bool {
+	if !tagChars.MatchString(tag) || strings.Contains(tag, "..") || strings.HasSuffix(tag, ".") {
+		return false
+	}
+	for _, component := range strings.Split(tag, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// project returns the owner/repo the job belongs to, taken from its BuildKey
+func (job *JobDetails) project() string {
+	return projectOf(job.BuildKey)
+}
+
+// cacheVolume returns the name of the docker volume holding the project's dependency cache
+// e.g sicuro_cache_0sc_sicuro for the job with BuildKey 0sc/sicuro/master
+func cacheVolume(job *JobDetails) string {
+	project := job.project()
+	if project == "" {
+		return ""
+	}
+	return "sicuro_cache_" + invalidVolumeChars.ReplaceAllString(project, "_")
+}
@@ -0,0 +1,139 @@
+package ci
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidTag(t *testing.T) {
+	cases := []struct {
+		tag  string
+		want bool
+	}{
+		{"v1.0.0", true},
+		{"release/2018-05-01", true},
+		{"v1.0.0+build_1", true},
+		{"", false},
+		{"v1;rm -rf ~", false},
+		{"v1$(id)", false},
+		{"v1'", false},
+		{"v 1", false},
+		{"../../etc", false},
+		{"v1..2", false},
+		{"v1.", false},
+		{".v1", false},
+		{"release/.v1", false},
+		{"v1.lock", false},
+		{"release//v1", false},
+		{"/v1", false},
+		{"v1/", false},
+	}
+
+	for _, c := range cases {
+		if got := ValidTag(c.tag); got != c.want {
+			t.Errorf("ValidTag(%q) = %t; want %t", c.tag, got, c.want)
+		}
+	}
+}
+
+func TestPrepareEnvVars(t *testing.T) {
+	job := &JobDetails{
+		ProjectBranch:   "feature branch'; id",
+		ProjectLanguage: "ruby",
+		Tag:             "v1.0.0",
+		Deploy:          true,
+	}
+
+	args := prepareEnvVars(job)
+	if len(args)%2 != 0 {
+		t.Fatalf("prepareEnvVars() = %q; want -e VAR=value pairs", args)
+	}
+	env := map[string]string{}
+	for i := 0; i < len(args); i += 2 {
+		if args[i] != "-e" {
+			t.Fatalf("prepareEnvVars() = %q; want -e VAR=value pairs", args)
+		}
+		parts := strings.SplitN(args[i+1], "=", 2)
+		env[parts[0]] = parts[1]
+	}
+
+	want := map[string]string{
+		"PROJECT_BRANCH":   job.ProjectBranch,
+		"PROJECT_LANGUAGE": "ruby",
+		"SICURO_TAG":       "v1.0.0",
+		"SICURO_DEPLOY":    "true",
+	}
+	for name, value := range want {
+		if env[name] != value {
+			t.Errorf("%s = %q; want %q", name, env[name], value)
+		}
+	}
+	for _, name := range []string{"PROJECT_REF", "SICURO_REBUILD_CACHE"} {
+		if _, ok := env[name]; ok {
+			t.Errorf("%s is set; want it unset", name)
+		}
+	}
+}
+
+func TestKillWhenCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sicuro_docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the fake docker only kills the container once it's been created
+	created := filepath.Join(dir, "created")
+	script := fmt.Sprintf("#!/bin/sh\ntest -f %s\n", created)
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	defer func(interval time.Duration) { killInterval = interval }(killInterval)
+	killInterval = 10 * time.Millisecond
+
+	// cancelled before the container exists; it's killed once it does
+	job := &JobDetails{LogFileName: "octocat/hello/1", container: "sicuro_test", cancelled: true}
+	done := make(chan struct{})
+	killed := job.killWhenCancelled(done)
+	time.Sleep(5 * killInterval)
+	if err := ioutil.WriteFile(created, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ok := <-killed:
+		if !ok {
+			t.Error("killWhenCancelled gave up on a container created after the cancel")
+		}
+	case <-time.After(time.Second):
+		t.Error("killWhenCancelled didn't kill a container created after the cancel")
+	}
+	close(done)
+
+	// the container is gone before the kill; the build ran to the end
+	os.Remove(created)
+	done = make(chan struct{})
+	killed = job.killWhenCancelled(done)
+	time.Sleep(5 * killInterval)
+	close(done)
+	if <-killed {
+		t.Error("killWhenCancelled reported a container that was never killed as killed")
+	}
+
+	// a job that isn't cancelled isn't killed
+	job = &JobDetails{LogFileName: "octocat/hello/2", container: "sicuro_test"}
+	ioutil.WriteFile(created, nil, 0644)
+	done = make(chan struct{})
+	killed = job.killWhenCancelled(done)
+	time.Sleep(5 * killInterval)
+	close(done)
+	if <-killed {
+		t.Error("killWhenCancelled killed the container of a job that wasn't cancelled")
+	}
+}
@@ -0,0 +1,156 @@
+package ci
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// ConfigFileName is the name of the project config file at the root of the repository
+const ConfigFileName = "sicuro.json"
+
+// Config is the part of a project's sicuro.json acted on by the server
+// The build steps themselves are resolved from the file inside the test container
+type Config struct {
+	// Branches decides which branches are built
+	Branches BranchFilter `json:"branches"`
+	// Paths decides which pushes are built based on the files they change
+	Paths PathFilter `json:"paths"`
+	// ReportSkipped reports skipped builds to the VCS instead of only recording them
+	ReportSkipped bool `json:"report_skipped"`
+	// PullRequests decides which pull request events are built
+	PullRequests PullRequestConfig `json:"pull_requests"`
+	// Deploy decides which tags run the deploy steps
+	Deploy DeployConfig `json:"deploy"`
+	// Statuses decides the status contexts the build is reported under
+	Statuses StatusConfig `json:"statuses"`
+	// AutoCancel cancels the queued and running builds of a branch or pull request when a newer one is queued
+	AutoCancel bool `json:"auto_cancel"`
+}
+
+// DeployConfig is the config for the deploy steps run for tags
+// The steps themselves are run from the custom list in the test container
+type DeployConfig struct {
+	// Tags lists glob patterns e.g v* of the tags to deploy; all tags are deployed if it's empty
+	Tags []string `json:"tags"`
+	// Custom are the deploy commands; no tag is deployed if there are none
+	Custom []string `json:"custom"`
+}
+
+// StatusConfig is the config for the statuses a build reports to the VCS
+type StatusConfig struct {
+	// Steps lists the build steps e.g test or lint that report their own status as sicuro/<step>
+	// alongside the status of the whole build. The built in steps are checkout, dependencies, setup,
+	// test and deploy; custom commands can mark steps of their own
+	Steps []string `json:"steps"`
+}
+
+// PullRequestConfig is the config for builds of pull requests
+type PullRequestConfig struct {
+	// Actions lists the pull request actions that trigger a build
+	// It defaults to DefaultPullRequestActions if empty
+	Actions []string `json:"actions"`
+	// BuildMerge tests the result of merging the pull request into its base branch
+	// instead of the pull request's head commit
+	BuildMerge bool `json:"build_merge"`
+	// SummaryComment keeps a comment summarising the latest build up to date on the pull request
+	SummaryComment bool `json:"summary_comment"`
+}
+
+// BranchFilter is a list of glob patterns e.g feature/* of branches to build or not build
+type BranchFilter struct {
+	// Only lists the branches to build; all branches are built if it's empty
+	Only []string `json:"only"`
+	// Except lists branches not to build; it takes precedence over Only
+	Except []string `json:"except"`
+}
+
+// PathFilter is a list of glob patterns of files whose changes should or shouldn't trigger a build
+// Patterns without a slash match the file name in any directory e.g *.md
+// and patterns ending in /** match everything in the directory e.g docs/**
+type PathFilter struct {
+	// Include lists the files that trigger a build; all files do if it's empty
+	Include []string `json:"include"`
+	// Exclude lists files whose changes don't trigger a build; it takes precedence over Include
+	Exclude []string `json:"exclude"`
+}
+
+// DefaultPullRequestActions are the pull request actions that change the code to be tested
+var DefaultPullRequestActions = []string{"opened", "synchronize", "reopened"}
+
+// Builds returns true if the pull request action should trigger a build
+func (c PullRequestConfig) Builds(action string) bool {
+	actions := c.Actions
+	if len(actions) == 0 {
+		actions = DefaultPullRequestActions
+	}
+
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Deploys returns true if the tag should run the deploy steps
+func (c DeployConfig) Deploys(tag string) bool {
+	if len(c.Custom) == 0 {
+		return false
+	}
+	return len(c.Tags) == 0 || matchAny(c.Tags, tag, path.Match)
+}
+
+// ParseConfig parses the content of a sicuro.json file
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if len(data) == 0 {
+		return cfg, nil
+	}
+	return cfg, json.Unmarshal(data, cfg)
+}
+
+// Allows returns true if the branch should be built
+func (f BranchFilter) Allows(branch string) bool {
+	if matchAny(f.Except, branch, path.Match) {
+		return false
+	}
+	return len(f.Only) == 0 || matchAny(f.Only, branch, path.Match)
+}
+
+// Allows returns true if changes to the given files should be built
+// It returns true if the changed files aren't known
+func (f PathFilter) Allows(files []string) bool {
+	if len(files) == 0 {
+		return true
+	}
+
+	for _, file := range files {
+		if matchAny(f.Exclude, file, matchPath) {
+			continue
+		}
+		if len(f.Include) == 0 || matchAny(f.Include, file, matchPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, name string, match func(pattern, name string) (bool, error)) bool {
+	for _, pattern := range patterns {
+		if ok, _ := match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(pattern, file string) (bool, error) {
+	if dir := strings.TrimSuffix(pattern, "/**"); dir != pattern {
+		return strings.HasPrefix(file, dir+"/"), nil
+	}
+	if !strings.Contains(pattern, "/") {
+		return path.Match(pattern, path.Base(file))
+	}
+	return path.Match(pattern, file)
+}
@@ -0,0 +1,55 @@
+package ci
+
+import "testing"
+
+func TestBranchFilterAllows(t *testing.T) {
+	cases := []struct {
+		filter BranchFilter
+		branch string
+		want   bool
+	}{
+		{BranchFilter{}, "master", true},
+		{BranchFilter{Only: []string{"master", "release/*"}}, "master", true},
+		{BranchFilter{Only: []string{"master", "release/*"}}, "release/1.0", true},
+		{BranchFilter{Only: []string{"master", "release/*"}}, "feature/login", false},
+		// * doesn't match across slashes
+		{BranchFilter{Only: []string{"release/*"}}, "release/1.0/hotfix", false},
+		{BranchFilter{Except: []string{"wip/*"}}, "wip/login", false},
+		{BranchFilter{Except: []string{"wip/*"}}, "master", true},
+		// except takes precedence over only
+		{BranchFilter{Only: []string{"feature/*"}, Except: []string{"feature/wip"}}, "feature/wip", false},
+	}
+
+	for _, c := range cases {
+		if got := c.filter.Allows(c.branch); got != c.want {
+			t.Errorf("%+v.Allows(%s) = %t; want %t", c.filter, c.branch, got, c.want)
+		}
+	}
+}
+
+func TestPathFilterAllows(t *testing.T) {
+	cases := []struct {
+		filter PathFilter
+		files  []string
+		want   bool
+	}{
+		{PathFilter{Exclude: []string{"*.md"}}, nil, true},
+		{PathFilter{}, []string{"main.go"}, true},
+		// patterns without a slash match the file name in any directory
+		{PathFilter{Exclude: []string{"*.md"}}, []string{"README.md", "docs/setup.md"}, false},
+		{PathFilter{Exclude: []string{"*.md"}}, []string{"README.md", "main.go"}, true},
+		// patterns ending in /** match everything in the directory
+		{PathFilter{Exclude: []string{"docs/**"}}, []string{"docs/api/index.html"}, false},
+		{PathFilter{Exclude: []string{"docs/**"}}, []string{"docsite/index.html"}, true},
+		{PathFilter{Include: []string{"app/*.go"}}, []string{"app/main.go"}, true},
+		{PathFilter{Include: []string{"app/*.go"}}, []string{"app/vcs/github.go"}, false},
+		// exclude takes precedence over include
+		{PathFilter{Include: []string{"app/**"}, Exclude: []string{"*_test.go"}}, []string{"app/main_test.go"}, false},
+	}
+
+	for _, c := range cases {
+		if got := c.filter.Allows(c.files); got != c.want {
+			t.Errorf("%+v.Allows(%v) = %t; want %t", c.filter, c.files, got, c.want)
+		}
+	}
+}
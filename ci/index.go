@@ -0,0 +1,118 @@
+package ci
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/0sc/sicuro/store"
+)
+
+var (
+	// buildIndexes holds the buildIndex of each project keyed by owner/repo
+	buildIndexes = store.New("build_indexes")
+	// indexMu serializes updates to the build indexes
+	indexMu sync.Mutex
+)
+
+// buildIndex points to a project's latest builds so they're found without reading every build record
+type buildIndex struct {
+	// Keys maps each build key to the latest build with the key
+	Keys map[string]indexEntry
+	// Pushes maps each branch to its latest finished push build with each status
+	Pushes map[string]map[string]indexEntry
+}
+
+type indexEntry struct {
+	Name   string
+	Number int
+}
+
+func newBuildIndex() *buildIndex {
+	return &buildIndex{Keys: map[string]indexEntry{}, Pushes: map[string]map[string]indexEntry{}}
+}
+
+// add points the index to the build where it's the latest of its key or of a push with its status
+func (idx *buildIndex) add(b *Build) {
+	entry := indexEntry{Name: b.Name, Number: b.Number}
+	if latest, ok := idx.Keys[b.Key]; !ok || latest.Number <= b.Number {
+		idx.Keys[b.Key] = entry
+	}
+
+	// the status of a finished build doesn't change so the entry can't go stale
+	if !b.Finished() {
+		return
+	}
+	for _, t := range b.Triggers {
+		if !strings.HasPrefix(t, "push refs/heads/") {
+			continue
+		}
+		branch := strings.TrimPrefix(t, "push refs/heads/")
+		if idx.Pushes[branch] == nil {
+			idx.Pushes[branch] = map[string]indexEntry{}
+		}
+		if latest, ok := idx.Pushes[branch][b.Status]; !ok || latest.Number <= b.Number {
+			idx.Pushes[branch][b.Status] = entry
+		}
+	}
+}
+
+// projectIndex returns the project's build index
+func projectIndex(project string) *buildIndex {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	return loadIndex(project)
+}
+
+// loadIndex fetches the project's build index. The caller must hold indexMu
+// The index of a project whose builds were recorded before it existed is built from its build records
+func loadIndex(project string) *buildIndex {
+	idx := newBuildIndex()
+	found, err := buildIndexes.Get(project, idx)
+	if err != nil {
+		log.Printf("Error: %s occurred while fetching the build index of %s\n", err, project)
+	}
+	if found && err == nil {
+		return idx
+	}
+
+	idx = newBuildIndex()
+	for _, b := range ProjectBuilds(project, BuildFilter{}) {
+		idx.add(b)
+	}
+	if err := buildIndexes.Put(project, idx); err != nil {
+		log.Printf("Error: %s occurred while saving the build index of %s\n", err, project)
+	}
+	return idx
+}
+
+// indexBuild adds the recorded build to its project's index
+func indexBuild(b *Build) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	project := projectOf(b.Name)
+	idx := loadIndex(project)
+	idx.add(b)
+	if err := buildIndexes.Put(project, idx); err != nil {
+		log.Printf("Error: %s occurred while indexing build %s\n", err, b.Name)
+	}
+}
+
+// removeIndex deletes the project's build index e.g once its builds are archived
+func removeIndex(project string) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if err := buildIndexes.Delete(project); err != nil {
+		log.Printf("Error: %s occurred while deleting the build index of %s\n", err, project)
+	}
+}
+
+// projectOf returns the owner/repo part of a build name or key
+func projectOf(name string) string {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[0] + "/" + parts[1]
+}
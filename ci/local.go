@@ -0,0 +1,92 @@
+package ci
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// localSourceDIR is where the working copy is mounted in the test container
+const localSourceDIR = "/source"
+
+var (
+	// languageMarkers maps files found at the root of a project to the project's language
+	// It's used to detect the language of a local working copy
+	languageMarkers = []struct {
+		file     string
+		language string
+	}{
+		{"Gemfile", "ruby"},
+		{"package.json", "javascript"},
+	}
+
+	// ErrUnknownLanguage is returned when the language of a working copy can't be detected
+	ErrUnknownLanguage = errors.New("couldn't detect the project language")
+)
+
+// LocalJob contains the information required to run a project's tests against a local working copy
+type LocalJob struct {
+	// SourceDir is the path to the working copy
+	// It's mounted read-only in the test container in place of cloning the project
+	SourceDir string
+	// ProjectLanguage is the programming language the project is written in
+	// It's detected from the working copy if left empty
+	ProjectLanguage string
+	// Network is the docker network to attach the test container to
+	// e.g ci_default to use the resources started with docker-compose
+	Network string
+	// Output receives the test output as it's produced
+	Output io.Writer
+}
+
+// DetectLanguage guesses the language of the project in the given directory from the files it contains
+func DetectLanguage(dir string) (string, error) {
+	for _, marker := range languageMarkers {
+		if _, err := os.Stat(filepath.Join(dir, marker.file)); err == nil {
+			return marker.language, nil
+		}
+	}
+	return "", ErrUnknownLanguage
+}
+
+// RunLocal runs the tests for the given job in the foreground
+// It uses the same image and pipeline steps that the server would use for the project
+// It returns the error from the test container; an *exec.ExitError if the tests failed
+func RunLocal(job *LocalJob) error {
+	dir, err := filepath.Abs(job.SourceDir)
+	if err != nil {
+		return err
+	}
+
+	if job.ProjectLanguage == "" {
+		if job.ProjectLanguage, err = DetectLanguage(dir); err != nil {
+			return err
+		}
+	}
+	job.ProjectLanguage = strings.ToLower(job.ProjectLanguage)
+	if !supportedLanguage(job.ProjectLanguage) {
+		return fmt.Errorf("projects written in %q are currently not supported", job.ProjectLanguage)
+	}
+
+	details := &JobDetails{
+		ProjectRespositoryName: filepath.Base(dir),
+		ProjectLanguage:        job.ProjectLanguage,
+	}
+
+	args := []string{"run", "--rm", "-v", fmt.Sprintf("%s:%s:ro", dir, localSourceDIR)}
+	args = append(args, prepareEnvVars(details)...)
+	args = append(args, "-e", "PROJECT_SOURCE_DIR="+localSourceDIR)
+	if job.Network != "" {
+		args = append(args, "--network", job.Network)
+	}
+	args = append(args, availableImages[job.ProjectLanguage])
+
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = job.Output
+	cmd.Stderr = job.Output
+	return cmd.Run()
+}
@@ -0,0 +1,78 @@
+package ci
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArchiveDIR is the absolute path to the directory holding the logs and build records of archived projects
+var ArchiveDIR = filepath.Join(ciDIR, "archive")
+
+// ArchiveProject moves the project's logs and build records out of its history into ArchiveDIR
+// The project's build numbers are kept so a later build doesn't reuse an archived build's number
+// project is of the form owner/repo. It returns the directory the history was archived to
+func ArchiveProject(project string) (string, error) {
+	dir := filepath.Join(ArchiveDIR, project, time.Now().Format("20060102150405"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(filepath.Join(LogDIR, project), filepath.Join(dir, "logs")); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(ProjectBuilds(project, BuildFilter{}), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "builds.json"), data, 0644); err != nil {
+		return "", err
+	}
+
+	removeProjectRecords(project)
+	return dir, nil
+}
+
+// DeleteProject deletes the project's logs, build records and build numbers
+// project is of the form owner/repo
+func DeleteProject(project string) error {
+	if err := os.RemoveAll(filepath.Join(LogDIR, project)); err != nil {
+		return err
+	}
+
+	removeProjectRecords(project)
+	if err := buildNumbers.Delete(project); err != nil {
+		log.Printf("Error: %s occurred while deleting the build number of %s\n", err, project)
+	}
+	return nil
+}
+
+func removeProjectRecords(project string) {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+
+	for _, b := range ProjectBuilds(project, BuildFilter{}) {
+		if err := builds.Delete(b.Name); err != nil {
+			log.Printf("Error: %s occurred while deleting build %s\n", err, b.Name)
+		}
+	}
+	removeIndex(project)
+
+	keys, err := branches.Keys()
+	if err != nil {
+		log.Println("Error occurred while listing branches: ", err)
+		return
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, project+"#") {
+			if err := branches.Delete(key); err != nil {
+				log.Printf("Error: %s occurred while deleting branch %s\n", err, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package ci
+
+import (
+	"bufio"
+	"bytes"
+	"html"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// AnnotationFailure is the level of an annotation for a failing test or a lint error
+	AnnotationFailure = "failure"
+	// AnnotationWarning is the level of an annotation for a lint warning
+	AnnotationWarning = "warning"
+	// AnnotationNotice is the level of an annotation for a style or refactoring suggestion
+	AnnotationNotice = "notice"
+
+	// maxAnnotations is the most annotations kept from a build's log
+	maxAnnotations = 200
+	// maxLogLine is the longest line read from a build's log; the rest of the log is ignored after a longer one
+	maxLogLine = 1024 * 1024
+)
+
+var (
+	logMarkup = regexp.MustCompile(`<[^>]*>`)
+	// rspecFailure matches the rerun lines rspec prints for failed examples
+	// e.g rspec ./spec/models/user_spec.rb:12 # User validates the email
+	rspecFailure = regexp.MustCompile(`^rspec (\S+):(\d+) # (.+)$`)
+	// lintProblem matches the file:line:column: message lines of rubocop, eslint's unix format and compilers
+	// e.g app/models/user.rb:10:5: C: Style/StringLiterals: Prefer single-quoted strings
+	lintProblem = regexp.MustCompile(`^(\S+\.\w+):(\d+):(?:\d+:)? (?:([CWREF]): )?(.+)$`)
+	// coverageSummaries match the lines coverage tools report the percentage of lines covered with
+	// i.e simplecov, and istanbul's text-summary and text reporters
+	coverageSummaries = []*regexp.Regexp{
+		regexp.MustCompile(`LOC \((\d+(?:\.\d+)?)%\) covered`),
+		regexp.MustCompile(`^Lines\s*:\s*(\d+(?:\.\d+)?)%`),
+		regexp.MustCompile(`^All files\s*\|\s*[\d.]+\s*\|\s*[\d.]+\s*\|\s*[\d.]+\s*\|\s*(\d+(?:\.\d+)?)`),
+	}
+	// testSummaries match the lines test runners and linters end their output with
+	testSummaries = []*regexp.Regexp{
+		regexp.MustCompile(`^\d+ examples?, \d+ failures?.*$`),
+		regexp.MustCompile(`^Tests:\s+.*\d+ total$`),
+		regexp.MustCompile(`^\d+ (passing|failing|pending)\b.*$`),
+		regexp.MustCompile(`^\d+ files? inspected, .*$`),
+	}
+)
+
+// Annotation is a problem reported by a build's tests or linters at a line of a file
+type Annotation struct {
+	// Path is relative to the root of the repository
+	Path    string
+	Line    int
+	Level   string
+	Message string
+}
+
+// Report is what a build's log says about its tests
+type Report struct {
+	// Summary are the summary lines of the test runners and linters e.g 10 examples, 1 failure
+	Summary     []string
+	Annotations []Annotation
+	// Coverage is the percentage of lines covered by the tests, if it was reported
+	Coverage *float64
+}
+
+// BuildReport reads the report of the build with the given name from its log
+func BuildReport(name string) (*Report, error) {
+	data, err := ioutil.ReadFile(filepath.Join(LogDIR, name+LogFileExt))
+	if err != nil {
+		return nil, err
+	}
+
+	repo := ""
+	if parts := strings.Split(name, "/"); len(parts) > 1 {
+		repo = parts[1]
+	}
+	return parseReport(data, repo), nil
+}
+
+// readResults records the outcome of the build's steps and its coverage from its log
+func (job *JobDetails) readResults(buildStatus string) {
+	data, err := ioutil.ReadFile(job.logFilePath)
+	if err != nil {
+		log.Printf("Error: %s occurred while reading logfile %s\n", err, job.logFilePath)
+		return
+	}
+
+	repo := ""
+	if parts := strings.Split(job.LogFileName, "/"); len(parts) > 1 {
+		repo = parts[1]
+	}
+	job.steps = stepResults(data, buildStatus, job.Steps)
+	job.coverage = parseReport(data, repo).Coverage
+}
+
+func parseReport(data []byte, repo string) *Report {
+	report := &Report{}
+	seen := map[Annotation]bool{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	// allow for the long lines of minified or progress output
+	scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+	for scanner.Scan() {
+		line := strings.TrimSpace(html.UnescapeString(logMarkup.ReplaceAllString(scanner.Text(), "")))
+
+		for _, summary := range testSummaries {
+			if summary.MatchString(line) {
+				report.Summary = append(report.Summary, line)
+			}
+		}
+		for _, coverage := range coverageSummaries {
+			if m := coverage.FindStringSubmatch(line); m != nil {
+				if pct, err := strconv.ParseFloat(m[1], 64); err == nil {
+					report.Coverage = &pct
+				}
+			}
+		}
+
+		a, ok := parseAnnotation(line)
+		if !ok || len(report.Annotations) >= maxAnnotations {
+			continue
+		}
+		// the same problem may be logged with absolute and relative paths
+		a.Path = repoPath(a.Path, repo)
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		report.Annotations = append(report.Annotations, a)
+	}
+	return report
+}
+
+func parseAnnotation(line string) (Annotation, bool) {
+	if m := rspecFailure.FindStringSubmatch(line); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return Annotation{Path: m[1], Line: n, Level: AnnotationFailure, Message: m[3]}, true
+	}
+
+	if m := lintProblem.FindStringSubmatch(line); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return Annotation{Path: m[1], Line: n, Level: lintLevel(m[3], m[4]), Message: m[4]}, true
+	}
+	return Annotation{}, false
+}
+
+// lintLevel returns the annotation level of a lint problem from its rubocop severity or eslint message
+func lintLevel(severity, message string) string {
+	switch severity {
+	case "E", "F":
+		return AnnotationFailure
+	case "W":
+		return AnnotationWarning
+	case "C", "R":
+		return AnnotationNotice
+	}
+
+	if strings.Contains(message, "[Error") || strings.Contains(strings.ToLower(message), "error") {
+		return AnnotationFailure
+	}
+	return AnnotationWarning
+}
+
+// repoPath returns the path relative to the root of the repository cloned in the test container
+func repoPath(path, repo string) string {
+	if repo != "" {
+		if i := strings.LastIndex(path, "/"+repo+"/"); i >= 0 {
+			path = path[i+len(repo)+2:]
+		}
+	}
+	return strings.TrimPrefix(path, "./")
+}
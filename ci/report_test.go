@@ -0,0 +1,60 @@
+package ci
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReport(t *testing.T) {
+	log := strings.Join([]string{
+		"<h4>Running tests</h4>",
+		"<p>Failures:</p>",
+		"rspec /home/app/hello/spec/models/user_spec.rb:12 # User validates the email",
+		"rspec ./spec/models/user_spec.rb:12 # User validates the email",
+		"<span>10 examples, 1 failure</span>",
+		"app/models/user.rb:10:5: C: Style/StringLiterals: Prefer single-quoted strings",
+		"app/models/user.rb:20:1: E: Lint/Syntax: unexpected token",
+		"src/index.js:3:7: &#39;x&#39; is assigned a value but never used. [Warning/no-unused-vars]",
+		"12 files inspected, 3 offenses detected",
+		"Coverage report generated. 120 / 150 LOC (80.5%) covered.",
+	}, "\n")
+
+	report := parseReport([]byte(log), "hello")
+
+	wantSummary := []string{"10 examples, 1 failure", "12 files inspected, 3 offenses detected"}
+	if !reflect.DeepEqual(report.Summary, wantSummary) {
+		t.Errorf("Summary = %q; want %q", report.Summary, wantSummary)
+	}
+
+	wantAnnotations := []Annotation{
+		// the repeated failure is reported once with its path relative to the repo
+		{Path: "spec/models/user_spec.rb", Line: 12, Level: AnnotationFailure, Message: "User validates the email"},
+		{Path: "app/models/user.rb", Line: 10, Level: AnnotationNotice, Message: "Style/StringLiterals: Prefer single-quoted strings"},
+		{Path: "app/models/user.rb", Line: 20, Level: AnnotationFailure, Message: "Lint/Syntax: unexpected token"},
+		{Path: "src/index.js", Line: 3, Level: AnnotationWarning, Message: "'x' is assigned a value but never used. [Warning/no-unused-vars]"},
+	}
+	if !reflect.DeepEqual(report.Annotations, wantAnnotations) {
+		t.Errorf("Annotations = %+v; want %+v", report.Annotations, wantAnnotations)
+	}
+
+	if report.Coverage == nil || *report.Coverage != 80.5 {
+		t.Errorf("Coverage = %v; want 80.5", report.Coverage)
+	}
+}
+
+func TestParseReportCapsAnnotations(t *testing.T) {
+	lines := []string{}
+	for i := 1; i <= maxAnnotations+10; i++ {
+		lines = append(lines, fmt.Sprintf("rspec ./spec/user_spec.rb:%d # fails", i))
+	}
+
+	report := parseReport([]byte(strings.Join(lines, "\n")), "hello")
+	if len(report.Annotations) != maxAnnotations {
+		t.Errorf("%d annotations were kept; want %d", len(report.Annotations), maxAnnotations)
+	}
+	if report.Coverage != nil || len(report.Summary) != 0 {
+		t.Errorf("report = %+v; want no coverage or summary", report)
+	}
+}
@@ -1,17 +1,30 @@
 #!/bin/bash
 trap 'exit' ERR
 
-# the first argument, $1, is the a list of the enviroment variables
-# mostly those for resources such as 
+# the first argument, $1, is the docker image of the project's language
+# which is gotten from the github details for the project
+# ----
+# the second argument is the name of the docker volume used to cache the project's
+# dependencies between builds. It's mounted at /cache in the container
+# ----
+# the third argument is the name given to the container so the build can be cancelled
+# ----
+# the rest of the arguments are the docker run options setting the enviroment variables
+# mostly those for resources such as
 # DATABASE_URL, REDIS_URL etc
 # example: -e DATABASE_URL=postgres://postgres@postgres:5432 -e REDIS_URL=redis://redis
-# ----
-# the second argument is the language of the project
-# which is gotten from the github details for the project
+# Each option and value is its own argument; they're passed on to docker as they are
+
+DOCKER_IMAGE=${1}
+CACHE_VOLUME=${2}
+CONTAINER_NAME=${3}
+shift 3
 
-DOCKER_ENVS=${1}
-DOCKER_IMAGE=${2}
+DOCKER_VOLUMES="-v ${CI_DIR}/.ssh:/.ssh"
+if [ -n "$CACHE_VOLUME" ]; then
+	DOCKER_VOLUMES="$DOCKER_VOLUMES -v $CACHE_VOLUME:/cache"
+fi
 
-docker run --rm -v ${CI_DIR}/.ssh:/.ssh \
-				--network ci_default $DOCKER_ENVS $DOCKER_IMAGE
+docker run --rm --name "$CONTAINER_NAME" $DOCKER_VOLUMES \
+				--network ci_default "$@" "$DOCKER_IMAGE"
 				
\ No newline at end of file
@@ -0,0 +1,73 @@
+package ci
+
+import (
+	"regexp"
+)
+
+// stepMarker matches the lines the test container logs as each step of the build starts and finishes
+// e.g <!-- sicuro:step test start -->
+var stepMarker = regexp.MustCompile(`<!-- sicuro:step ([\w.-]+) (start|done) -->`)
+
+// StepResult is the outcome of a step of a build e.g test or lint
+type StepResult struct {
+	Name   string
+	Status string
+}
+
+// stepResults returns the outcome of each step marked in the build log, in the order they started,
+// followed by the given steps that weren't marked. A step that started but didn't finish takes the
+// build's status. Steps that didn't run are skipped if the build succeeded and errored otherwise
+func stepResults(data []byte, buildStatus string, steps []string) []StepResult {
+	results := []StepResult{}
+	index := map[string]int{}
+
+	for _, m := range stepMarker.FindAllSubmatch(data, -1) {
+		name, event := string(m[1]), string(m[2])
+		i, ok := index[name]
+		if !ok {
+			i = len(results)
+			index[name] = i
+			results = append(results, StepResult{Name: name, Status: buildStatus})
+		}
+		if event == "done" {
+			results[i].Status = StatusSuccess
+		}
+	}
+
+	notRun := StatusError
+	if buildStatus == StatusSuccess {
+		notRun = StatusSkipped
+	}
+	for _, name := range steps {
+		if _, ok := index[name]; !ok {
+			index[name] = len(results)
+			results = append(results, StepResult{Name: name, Status: notRun})
+		}
+	}
+	return results
+}
+
+// reportSteps executes the job's UpdateStepStatus callback for each of its Steps
+// While the build runs they're all pending; afterwards they're reported with their outcome
+func (job *JobDetails) reportSteps(buildStatus string) {
+	if job.UpdateStepStatus == nil {
+		return
+	}
+
+	if buildStatus == StatusPending {
+		for _, name := range job.Steps {
+			job.UpdateStepStatus(name, StatusPending)
+		}
+		return
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range job.Steps {
+		wanted[name] = true
+	}
+	for _, step := range job.steps {
+		if wanted[step.Name] {
+			job.UpdateStepStatus(step.Name, step.Status)
+		}
+	}
+}
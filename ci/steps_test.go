@@ -0,0 +1,81 @@
+package ci
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStepResults(t *testing.T) {
+	log := []byte(`<!-- sicuro:step checkout start -->
+<!-- sicuro:step checkout done -->
+<!-- sicuro:step setup start -->
+<!-- sicuro:step lint start -->
+<!-- sicuro:step lint done -->
+<!-- sicuro:step setup done -->
+<!-- sicuro:step test start -->
+1 example, 1 failure`)
+
+	cases := []struct {
+		buildStatus string
+		steps       []string
+		want        []StepResult
+	}{
+		{
+			StatusFailure,
+			[]string{"test", "deploy"},
+			[]StepResult{
+				{"checkout", StatusSuccess},
+				{"setup", StatusSuccess},
+				{"lint", StatusSuccess},
+				// the step that didn't finish takes the build's status
+				{"test", StatusFailure},
+				{"deploy", StatusError},
+			},
+		},
+		{
+			StatusCancelled,
+			nil,
+			[]StepResult{
+				{"checkout", StatusSuccess},
+				{"setup", StatusSuccess},
+				{"lint", StatusSuccess},
+				{"test", StatusCancelled},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		if got := stepResults(log, c.buildStatus, c.steps); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("stepResults(%s, %v) = %v; want %v", c.buildStatus, c.steps, got, c.want)
+		}
+	}
+
+	// configured steps that didn't run in a passing build were skipped
+	want := []StepResult{{"checkout", StatusSuccess}, {"deploy", StatusSkipped}}
+	done := []byte("<!-- sicuro:step checkout start -->\n<!-- sicuro:step checkout done -->")
+	if got := stepResults(done, StatusSuccess, []string{"deploy", "checkout", "deploy"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("stepResults() = %v; want %v", got, want)
+	}
+}
+
+func TestReportSteps(t *testing.T) {
+	reported := map[string]string{}
+	job := &JobDetails{
+		Steps: []string{"test", "deploy"},
+		UpdateStepStatus: func(step, state string) {
+			reported[step] = state
+		},
+	}
+
+	job.reportSteps(StatusPending)
+	if want := map[string]string{"test": StatusPending, "deploy": StatusPending}; !reflect.DeepEqual(reported, want) {
+		t.Errorf("reported %v while the build runs; want %v", reported, want)
+	}
+
+	// only the configured steps are reported
+	job.steps = []StepResult{{"checkout", StatusSuccess}, {"test", StatusFailure}, {"deploy", StatusError}}
+	job.reportSteps(StatusFailure)
+	if want := map[string]string{"test": StatusFailure, "deploy": StatusError}; !reflect.DeepEqual(reported, want) {
+		t.Errorf("reported %v once the build finished; want %v", reported, want)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// client talks to the sicuro server API on behalf of the user owning token
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// build is a single entry in a project's build listing
+type build struct {
+	Name     string   `json:"name"`
+	Key      string   `json:"key"`
+	Number   int      `json:"number"`
+	Active   bool     `json:"active"`
+	Status   string   `json:"status"`
+	Triggers []string `json:"triggers"`
+}
+
+// triggeredBuild describes a build the server has accepted
+type triggeredBuild struct {
+	Build string `json:"build"`
+	URL   string `json:"url"`
+	Log   string `json:"log"`
+}
+
+// logChunk is a slice of a build log starting at Offset
+type logChunk struct {
+	Build      string `json:"build"`
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"next_offset"`
+	Data       string `json:"data"`
+	Active     bool   `json:"active"`
+	Status     string `json:"status"`
+	Finished   bool   `json:"finished"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newClient(server, token string) *client {
+	return &client{
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do makes the API request decoding the JSON response into v
+// It returns the response's headers e.g the Link header of paginated listings
+func (c *client) do(method, path string, query url.Values, v interface{}) (http.Header, error) {
+	u := c.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		e := apiError{}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, fmt.Errorf("unexpected response from server: %s", err)
+	}
+	return resp.Header, nil
+}
+
+// Builds lists a page of the builds of the given project, most recent first
+// It returns true if there are older builds on the next page
+func (c *client) Builds(owner, project string, page int) ([]build, bool, error) {
+	builds := []build{}
+	query := url.Values{"owner": {owner}, "project": {project}, "page": {fmt.Sprint(page)}}
+	header, err := c.do("GET", "/api/builds", query, &builds)
+	if err != nil {
+		return nil, false, err
+	}
+	return builds, strings.Contains(header.Get("Link"), `rel="next"`), nil
+}
+
+// Run triggers a build of repo which takes the form owner/project/ref
+func (c *client) Run(repo string) (*triggeredBuild, error) {
+	b := &triggeredBuild{}
+	_, err := c.do("POST", "/api/run", url.Values{"repo": {repo}}, b)
+	return b, err
+}
+
+// Log fetches the part of the build's log after offset
+func (c *client) Log(name string, offset int64) (*logChunk, error) {
+	chunk := &logChunk{}
+	query := url.Values{"offset": {fmt.Sprint(offset)}}
+	_, err := c.do("GET", "/api/logs/"+name, query, chunk)
+	return chunk, err
+}
@@ -0,0 +1,280 @@
+// Command sicuro is a command line client for the sicuro CI server.
+// It lists a project's builds, triggers builds and tails build logs
+// so scripts don't have to go through the web UI.
+// It can also run a project's tests against a local working copy
+// exactly as the server would, without pushing.
+//
+// It authenticates with a personal API token created on the dashboard,
+// read from the SICURO_TOKEN environment variable.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/0sc/sicuro/ci"
+)
+
+const (
+	exitSuccess = 0
+	// exitFailure is returned when the build's tests failed
+	exitFailure = 1
+	// exitError is returned when the build couldn't run
+	exitError = 2
+	// exitUsage is returned when the command itself couldn't complete
+	exitUsage = 3
+
+	// pollPeriod is how often the log is polled while tailing a build
+	pollPeriod = 2 * time.Second
+)
+
+var (
+	server = flag.String("server", envOr("SICURO_SERVER", "http://localhost:8080"), "address of the sicuro server")
+	token  = flag.String("token", os.Getenv("SICURO_TOKEN"), "API token; defaults to $SICURO_TOKEN")
+
+	htmlTags = regexp.MustCompile(`<[^>]*>`)
+)
+
+const usage = `Usage: sicuro [flags] <command> [args]
+
+Commands:
+  builds [-page n] owner/project
+                                list the project's builds, most recent first
+  run [-wait] owner/project/ref trigger a build of ref; with -wait tail the log
+                                and exit with the build's result
+  logs [-f] owner/project/builds/number
+                                print a build's log; with -f follow it until
+                                the build finishes and exit with its result
+  exec [-lang language] [-network name] [dir]
+                                run the tests for the working copy in dir
+                                (default .) with the server's image and steps
+
+Exit codes: 0 success, 1 tests failed, 2 build error, 3 command error
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	os.Exit(runCommand(flag.Arg(0), flag.Args()[1:]))
+}
+
+func runCommand(name string, args []string) int {
+	if name == "exec" {
+		return execCommand(args)
+	}
+
+	if *token == "" {
+		fmt.Fprintln(os.Stderr, "An API token is required. Create one on the dashboard and set SICURO_TOKEN")
+		return exitUsage
+	}
+	c := newClient(*server, *token)
+
+	switch name {
+	case "builds":
+		return buildsCommand(c, args)
+	case "run":
+		return runBuildCommand(c, args)
+	case "logs":
+		return logsCommand(c, args)
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n", name)
+	flag.Usage()
+	return exitUsage
+}
+
+func buildsCommand(c *client, args []string) int {
+	fs := flag.NewFlagSet("builds", flag.ExitOnError)
+	page := fs.Int("page", 1, "the page of builds to list")
+	fs.Parse(args)
+
+	details := strings.Split(fs.Arg(0), "/")
+	if len(details) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: sicuro builds [-page n] owner/project")
+		return exitUsage
+	}
+
+	builds, more, err := c.Builds(details[0], details[1], *page)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listing builds:", err)
+		return exitUsage
+	}
+
+	for _, b := range builds {
+		status := b.Status
+		if b.Active {
+			status = "running"
+		}
+		fmt.Printf("#%-6d %-10s %-40s %s\n", b.Number, status, b.Name, strings.Join(b.Triggers, ", "))
+	}
+	if more {
+		fmt.Printf("Older builds: sicuro builds -page %d %s\n", *page+1, fs.Arg(0))
+	}
+	return exitSuccess
+}
+
+func runBuildCommand(c *client, args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	wait := fs.Bool("wait", false, "tail the build log and exit with the build's result")
+	fs.Parse(args)
+
+	if len(strings.Split(fs.Arg(0), "/")) != 3 {
+		fmt.Fprintln(os.Stderr, "Usage: sicuro run [-wait] owner/project/ref")
+		return exitUsage
+	}
+
+	b, err := c.Run(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error triggering build:", err)
+		return exitUsage
+	}
+	fmt.Fprintln(os.Stderr, "Build started:", b.URL)
+
+	if !*wait {
+		return exitSuccess
+	}
+	return tailLog(c, b.Build, true)
+}
+
+func logsCommand(c *client, args []string) int {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := fs.Bool("f", false, "follow the log until the build finishes and exit with the build's result")
+	fs.Parse(args)
+
+	if len(strings.Split(fs.Arg(0), "/")) < 3 {
+		fmt.Fprintln(os.Stderr, "Usage: sicuro logs [-f] owner/project/builds/number")
+		return exitUsage
+	}
+	return tailLog(c, fs.Arg(0), *follow)
+}
+
+func execCommand(args []string) int {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	lang := fs.String("lang", "", "language of the project; detected from the working copy by default")
+	network := fs.String("network", "", "docker network to attach to e.g ci_default for the docker-compose resources")
+	fs.Parse(args)
+
+	dir := fs.Arg(0)
+	if dir == "" {
+		dir = "."
+	}
+
+	out := &htmlStripper{w: os.Stdout}
+	job := &ci.LocalJob{
+		SourceDir:       dir,
+		ProjectLanguage: *lang,
+		Network:         *network,
+		Output:          out,
+	}
+
+	err := ci.RunLocal(job)
+	out.Flush()
+
+	if _, ok := err.(*exec.ExitError); ok {
+		fmt.Fprintln(os.Stderr, "Tests failed:", err)
+		return exitFailure
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error running tests:", err)
+		return exitError
+	}
+	return exitSuccess
+}
+
+// htmlStripper removes the html markup from build output a line at a time
+type htmlStripper struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (s *htmlStripper) Write(p []byte) (int, error) {
+	s.buf.Write(p)
+	for {
+		i := bytes.IndexByte(s.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := s.buf.Next(i + 1)
+		if _, err := io.WriteString(s.w, stripHTML(string(line))); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush writes out any incomplete last line
+func (s *htmlStripper) Flush() {
+	io.WriteString(s.w, stripHTML(s.buf.String()))
+	s.buf.Reset()
+}
+
+func stripHTML(text string) string {
+	return html.UnescapeString(htmlTags.ReplaceAllString(text, ""))
+}
+
+// tailLog prints the build's log to stdout
+// When following, it polls for more output until the build finishes
+// and returns the exit code matching the build's result
+func tailLog(c *client, name string, follow bool) int {
+	var offset int64
+	for {
+		chunk, err := c.Log(name, offset)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error fetching log:", err)
+			return exitUsage
+		}
+
+		text := chunk.Data
+		// hold back a tag split across chunks until the rest of it arrives
+		if i := strings.LastIndex(text, "<"); i > strings.LastIndex(text, ">") && !chunk.Finished {
+			text = text[:i]
+		}
+		fmt.Print(stripHTML(text))
+		// the server's offsets count the log's bytes; Data may have been changed by JSON decoding e.g invalid
+		// UTF-8 is replaced, so the next offset is taken from the server less what was held back
+		offset = chunk.NextOffset - int64(len(chunk.Data)-len(text))
+
+		if !follow {
+			return exitSuccess
+		}
+		if chunk.Finished {
+			return exitCode(chunk.Status)
+		}
+		time.Sleep(pollPeriod)
+	}
+}
+
+func exitCode(status string) int {
+	switch status {
+	case ci.StatusSuccess:
+		return exitSuccess
+	case ci.StatusFailure:
+		return exitFailure
+	}
+	return exitError
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -1,21 +1,44 @@
 #!/bin/bash
 trap 'exit' ERR
 
+# step markers let the server report each step of the build on its own
+# custom commands in sicuro.json can mark steps of their own e.g sicuro_step_start lint
+sicuro_step_start() { echo "<!-- sicuro:step $1 start -->"; }
+sicuro_step_done() { echo "<!-- sicuro:step $1 done -->"; }
+
 source /etc/profile
 
 echo "<h3>Starting the build</h3>"
 
-echo "<h3>Adding SSH keys</h3>"
-mkdir -p /root/.ssh/ && cp -R .ssh/* "$_"
-chmod 600 /root/.ssh/* &&\
-    ssh-keyscan github.com > /root/.ssh/known_hosts &&\
-    ssh-keyscan bitbucket.com >> /root/.ssh/known_hosts
-echo 
-
-echo "<h3>Checkout source code</h3>"
-git clone ${PROJECT_REPOSITORY_URL} ${PROJECT_REPOSITORY_NAME} 
-cd ${PROJECT_REPOSITORY_NAME}
-git checkout ${PROJECT_BRANCH}
+sicuro_step_start checkout
+if [ -n "${PROJECT_SOURCE_DIR}" ]; then
+    # a local working copy is mounted in place of cloning the repository
+    # copy it so the build doesn't write into the working copy
+    echo "<h3>Copying local source code</h3>"
+    mkdir -p ${PROJECT_REPOSITORY_NAME} && cp -R ${PROJECT_SOURCE_DIR}/. "$_"
+    cd ${PROJECT_REPOSITORY_NAME}
+else
+    echo "<h3>Adding SSH keys</h3>"
+    mkdir -p /root/.ssh/ && cp -R .ssh/* "$_"
+    chmod 600 /root/.ssh/* &&\
+        ssh-keyscan github.com > /root/.ssh/known_hosts &&\
+        ssh-keyscan bitbucket.com >> /root/.ssh/known_hosts
+    echo 
+
+    echo "<h3>Checkout source code</h3>"
+    git clone ${PROJECT_REPOSITORY_URL} ${PROJECT_REPOSITORY_NAME} 
+    cd ${PROJECT_REPOSITORY_NAME}
+    git checkout ${PROJECT_BRANCH}
+    if [ -n "${PROJECT_REF}" ]; then
+        # a ref to test in place of the branch e.g refs/pull/12/merge
+        # which is the result of merging a pull request into its base
+        echo "<h3>Checkout ${PROJECT_REF}</h3>"
+        git fetch origin ${PROJECT_REF}
+        git checkout FETCH_HEAD
+        echo "<!-- sicuro:merge-sha $(git rev-parse HEAD) -->"
+    fi
+fi
+sicuro_step_done checkout
 echo
 
 # check if sicuro.json is present
@@ -26,7 +49,17 @@ if [ -r ./sicuro.json ]; then
     SICURO_CONFIG_PRESENT=true
 fi
 
+# dependencies are cached between builds when a cache volume is mounted
+if [ -d /cache ]; then
+    if [ "${SICURO_REBUILD_CACHE}" = "true" ]; then
+        echo "<h3>Clearing the dependency cache</h3>"
+        rm -rf /cache/*
+    fi
+    export npm_config_cache=/cache/npm
+fi
+
 echo "<h3>Dependencies</h3>"
+sicuro_step_start dependencies
 if ! ($SICURO_CONFIG_PRESENT && $(cat $SICURO_CONFIG_FILE | jq --raw-output '. | .dependencies.override//false'))  ; then
     # default language dependencies
     echo Exporting NODE_ENV
@@ -35,8 +68,10 @@ fi
 if $SICURO_CONFIG_PRESENT ; then
     source <(cat $SICURO_CONFIG_FILE | jq --raw-output '. | .dependencies.custom[]?')
 fi
+sicuro_step_done dependencies
 
 echo "<h3>Setup</h3>"
+sicuro_step_start setup
 if ! ($SICURO_CONFIG_PRESENT && $(cat $SICURO_CONFIG_FILE | jq --raw-output '. | .setup.override//false')); then
     # default language setup
     npm install
@@ -44,8 +79,10 @@ fi
 if $SICURO_CONFIG_PRESENT ; then
     source <(cat $SICURO_CONFIG_FILE | jq --raw-output '. | .setup.custom[]?')
 fi
+sicuro_step_done setup
 
 echo "<h3>Test</h3>"
+sicuro_step_start test
 if ! ($SICURO_CONFIG_PRESENT && $(cat $SICURO_CONFIG_FILE | jq --raw-output '. | .test.override//false')); then
     # default language test command
     npm test
@@ -53,5 +90,14 @@ fi
 if $SICURO_CONFIG_PRESENT ; then
     source <(cat $SICURO_CONFIG_FILE | jq --raw-output '. | .test.custom[]?')
 fi
+sicuro_step_done test
+
+# deploy only runs for tags matching the deploy config, after the tests pass
+if [ "${SICURO_DEPLOY}" = "true" ] && $SICURO_CONFIG_PRESENT ; then
+    echo "<h3>Deploy ${SICURO_TAG}</h3>"
+    sicuro_step_start deploy
+    source <(cat $SICURO_CONFIG_FILE | jq --raw-output '. | .deploy.custom[]?')
+    sicuro_step_done deploy
+fi
 
 exec "$@"
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// BlobExt is the file extension used for blob files
+const BlobExt = ".blob"
+
+// Blobs is a set of opaque records each persisted to its own file in a directory of the DataDIR
+// It's meant for large records e.g webhook payloads that would make rewriting a Collection on every change costly
+type Blobs struct {
+	name string
+}
+
+// NewBlobs returns the set of blobs with the given name
+func NewBlobs(name string) *Blobs {
+	return &Blobs{name: name}
+}
+
+// file returns the path of the blob with the given key
+// Keys are encoded so any key, e.g one taken from a request header, names a file in the blobs' directory
+func (b *Blobs) file(key string) string {
+	return filepath.Join(DataDIR, b.name, base64.RawURLEncoding.EncodeToString([]byte(key))+BlobExt)
+}
+
+// Get returns the content of the blob with the given key
+// It returns false if no blob exists for the key
+func (b *Blobs) Get(key string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(b.file(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// Put saves data as the blob with the given key, replacing any existing blob
+func (b *Blobs) Put(key string, data []byte) error {
+	if err := os.MkdirAll(filepath.Join(DataDIR, b.name), 0755); err != nil {
+		return err
+	}
+
+	// write to a temp file first so a crash never leaves a half written blob
+	tmp := b.file(key) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.file(key))
+}
+
+// Delete removes the blob with the given key
+// It's a no-op if the blob doesn't exist
+func (b *Blobs) Delete(key string) error {
+	err := os.Remove(b.file(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// FileExt is the file extension used for collection files
+	FileExt = ".json"
+)
+
+var (
+	// DataDIR is the absolute path to the directory holding the collection files
+	DataDIR = filepath.Join(os.Getenv("ROOT_DIR"), "data")
+)
+
+// Collection is a set of JSON encoded records persisted to a single file in the DataDIR.
+// Records are kept in memory once loaded and every write flushes the whole collection to disk.
+// It's meant for the small amount of state the app needs to keep across restarts
+type Collection struct {
+	name    string
+	once    sync.Once
+	loadErr error
+	mu      sync.RWMutex
+	records map[string]json.RawMessage
+}
+
+// New returns the collection with the given name
+// The collection file is read lazily on first use
+func New(name string) *Collection {
+	return &Collection{name: name}
+}
+
+func (c *Collection) file() string {
+	return filepath.Join(DataDIR, c.name+FileExt)
+}
+
+func (c *Collection) load() error {
+	c.once.Do(func() {
+		c.records = map[string]json.RawMessage{}
+
+		data, err := ioutil.ReadFile(c.file())
+		if os.IsNotExist(err) {
+			return
+		}
+		if err != nil {
+			c.loadErr = err
+			return
+		}
+
+		if len(data) > 0 {
+			c.loadErr = json.Unmarshal(data, &c.records)
+		}
+		if c.loadErr != nil {
+			log.Printf("Error: %s occurred while loading collection %s\n", c.loadErr, c.name)
+		}
+	})
+	return c.loadErr
+}
+
+// flush writes the collection to disk. The caller must hold the write lock
+func (c *Collection) flush() error {
+	if err := os.MkdirAll(DataDIR, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(c.records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first so a crash never leaves a half written collection
+	tmp := c.file() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file())
+}
+
+// Get decodes the record with the given key into v
+// It returns false if no record exists for the key
+func (c *Collection) Get(key string, v interface{}) (bool, error) {
+	if err := c.load(); err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	raw, ok := c.records[key]
+	c.mu.RUnlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Put saves v as the record for the given key, replacing any existing record
+func (c *Collection) Put(key string, v interface{}) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records[key] = raw
+	return c.flush()
+}
+
+// Delete removes the record with the given key
+// It's a no-op if the record doesn't exist
+func (c *Collection) Delete(key string) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.records[key]; !ok {
+		return nil
+	}
+	delete(c.records, key)
+	return c.flush()
+}
+
+// Keys returns the keys of all records in the collection in sorted order
+func (c *Collection) Keys() ([]string, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.records))
+	for key := range c.records {
+		keys = append(keys, key)
+	}
+	c.mu.RUnlock()
+
+	sort.Strings(keys)
+	return keys, nil
+}
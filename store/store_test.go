@@ -0,0 +1,116 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type record struct {
+	Name  string
+	Count int
+}
+
+func withDataDIR(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "sicuro-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := DataDIR
+	DataDIR = dir
+	return func() {
+		DataDIR = orig
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCollection(t *testing.T) {
+	defer withDataDIR(t)()
+	c := New("records")
+
+	found, err := c.Get("missing", &record{})
+	if err != nil || found {
+		t.Fatalf("Get(missing) = %v, %v; want false, nil", found, err)
+	}
+
+	for _, r := range []record{{"b", 2}, {"a", 1}, {"c", 3}} {
+		if err := c.Put(r.Name, r); err != nil {
+			t.Fatalf("Put(%s) returned error: %s", r.Name, err)
+		}
+	}
+	if err := c.Put("b", record{"b", 20}); err != nil {
+		t.Fatalf("Put(b) returned error: %s", err)
+	}
+	if err := c.Delete("c"); err != nil {
+		t.Fatalf("Delete(c) returned error: %s", err)
+	}
+	if err := c.Delete("c"); err != nil {
+		t.Fatalf("Delete of a missing record returned error: %s", err)
+	}
+
+	keys, err := c.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys() = %v; want %v", keys, want)
+	}
+
+	got := record{}
+	if found, err := c.Get("b", &got); err != nil || !found || got != (record{"b", 20}) {
+		t.Errorf("Get(b) = %v, %v, %v; want {b 20}, true, nil", got, found, err)
+	}
+}
+
+func TestCollectionPersists(t *testing.T) {
+	defer withDataDIR(t)()
+
+	if err := New("records").Put("a", record{"a", 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := record{}
+	found, err := New("records").Get("a", &got)
+	if err != nil || !found || got != (record{"a", 1}) {
+		t.Errorf("reloaded Get(a) = %v, %v, %v; want {a 1}, true, nil", got, found, err)
+	}
+
+	if found, _ := New("others").Get("a", &got); found {
+		t.Error("records leaked into another collection")
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	defer withDataDIR(t)()
+	b := NewBlobs("payloads")
+
+	if _, found, err := b.Get("missing"); err != nil || found {
+		t.Fatalf("Get(missing) = %v, %v; want false, nil", found, err)
+	}
+
+	// keys can't escape the blobs' directory
+	for _, key := range []string{"abc-123", "../../escape", ""} {
+		if err := b.Put(key, []byte("payload of "+key)); err != nil {
+			t.Fatalf("Put(%q) returned error: %s", key, err)
+		}
+		data, found, err := b.Get(key)
+		if err != nil || !found || string(data) != "payload of "+key {
+			t.Errorf("Get(%q) = %q, %v, %v; want the payload", key, data, found, err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(DataDIR); len(files) != 1 || files[0].Name() != "payloads" {
+		t.Errorf("the data dir holds %v; want only the payloads dir", files)
+	}
+
+	if err := b.Delete("abc-123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("abc-123"); err != nil {
+		t.Errorf("Delete of a missing blob returned error: %s", err)
+	}
+	if _, found, _ := b.Get("abc-123"); found {
+		t.Error("Get() found a deleted blob")
+	}
+}
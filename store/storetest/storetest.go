@@ -0,0 +1,26 @@
+// Package storetest runs the tests of packages that keep state in the store against a throwaway DataDIR
+package storetest
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/0sc/sicuro/store"
+)
+
+// Main runs the package's tests with store.DataDIR set to a temporary directory that's removed afterwards
+// It's meant to be called from TestMain and returns the exit code of the tests e.g
+//
+//	func TestMain(m *testing.M) { os.Exit(storetest.Main(m)) }
+func Main(m *testing.M) int {
+	dir, err := ioutil.TempDir("", "sicuro-data")
+	if err != nil {
+		log.Fatal(err)
+	}
+	store.DataDIR = dir
+	defer os.RemoveAll(dir)
+
+	return m.Run()
+}